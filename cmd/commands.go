@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"thermostat-scheduler/internal/app"
+	"thermostat-scheduler/internal/config"
+	"time"
+)
+
+type command struct {
+	name    string
+	args    string // The arguments, for the usage, e.g., "<file>".
+	summary string
+
+	// The number of arguments the command takes.
+	minArgs, maxArgs int
+
+	// Whether the command runs without reading the config first.
+	withoutConfig bool
+
+	run func(ctx context.Context, cfg config.Config, args []string) error
+}
+
+var commands []*command
+
+// Set in init, since the commands refer to the usage, which lists them.
+func init() {
+	commands = []*command{
+		{
+			name:    "run",
+			summary: "Update the thermostat programs for the upcoming peak events. The default command.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.RunWithConfig(ctx, cfg, slog.Default(), *dryRun)
+			},
+		},
+		{
+			name:    "daemon",
+			summary: "Keep running, and update the thermostat programs whenever they must change. SIGHUP reloads the config.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				if cfg.Metrics.ListenAddress != "" {
+					closeMetrics, err := serveMetrics(cfg.Metrics.ListenAddress)
+					if err != nil {
+						return err
+					}
+					defer closeMetrics()
+				}
+				reload := make(chan os.Signal, 1)
+				signal.Notify(reload, syscall.SIGHUP)
+				defer signal.Stop(reload)
+				return app.DaemonContext(ctx, cfg, func() (config.Config, error) {
+					reloaded, err := readConfig()
+					// Keep using the same fake thermostat.
+					if *fakeThermostat {
+						reloaded.BlueLinkUrl = cfg.BlueLinkUrl
+						reloaded.FakeThermostat = true
+					}
+					return reloaded, err
+				}, reload, slog.Default(), *dryRun)
+			},
+		},
+		{
+			name:    "dashboard",
+			summary: "Serve a dashboard of the programs and peak events, with an API to update the programs and skip events.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				closeDashboard, err := serve(cfg.Dashboard.ListenAddress, "/", "dashboard",
+					app.NewDashboard(cfg, slog.Default(), *dryRun))
+				if err != nil {
+					return err
+				}
+				<-ctx.Done()
+				closeDashboard()
+				return nil
+			},
+		},
+		{
+			name:    "status",
+			summary: "Show the programs of the thermostats and the upcoming peak events.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.StatusContext(ctx, cfg, os.Stdout, slog.Default())
+			},
+		},
+		{
+			name:    "events",
+			summary: "List the upcoming peak events.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.EventsContext(ctx, cfg, os.Stdout, slog.Default())
+			},
+		},
+		{
+			name:    "skip",
+			args:    "<event>",
+			summary: "Leave a peak event, given by its start, e.g., 2024-01-15T06:00, out of the programs from the next run on.",
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				_, err := app.SkipContext(ctx, cfg, args[0], slog.Default())
+				return err
+			},
+		},
+		{
+			name:    "unskip",
+			args:    "<event>",
+			summary: "Plan for a skipped peak event again, from the next run on.",
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				_, err := app.UnskipContext(ctx, cfg, args[0], slog.Default())
+				return err
+			},
+		},
+		{
+			name:    "force",
+			args:    "<start> <duration>",
+			summary: "Add a peak event, e.g., 2024-01-15T06:00 3h, in local time, from the next run on. Skip it to cancel it.",
+			minArgs: 2,
+			maxArgs: 2,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				start, err := time.ParseInLocation("2006-01-02T15:04", args[0], time.Local)
+				if err != nil {
+					return fmt.Errorf("invalid start, expected e.g. 2024-01-15T06:00: %w", err)
+				}
+				duration, err := time.ParseDuration(args[1])
+				if err != nil {
+					return fmt.Errorf("invalid duration, expected e.g. 3h: %w", err)
+				}
+				_, err = app.ForceEvent(start, duration, slog.Default())
+				return err
+			},
+		},
+		{
+			name:    "plan",
+			summary: "Show the programs a run would give the thermostats, without talking to them.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.PlanContext(ctx, cfg, os.Stdout, slog.Default())
+			},
+		},
+		{
+			name:    "diff",
+			summary: "Show the changes a run would make to the thermostat programs, without making them.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.DiffContext(ctx, cfg, os.Stdout, slog.Default())
+			},
+		},
+		{
+			name:    "validate",
+			summary: "Check the config, without talking to the thermostats.",
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				fmt.Printf("%v is valid, with %v thermostat(s).\n", getConfigFileLocation(), len(cfg.Thermostats))
+				return nil
+			},
+		},
+		{
+			name:          "init",
+			summary:       "Write a config from the program the thermostat already has, asking for the rest.",
+			withoutConfig: true,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				if *fakeThermostat {
+					return errors.New("init needs the actual thermostat to read its program")
+				}
+				return app.InitContext(ctx, os.Stdin, os.Stdout, getConfigFileLocation(), "", slog.Default())
+			},
+		},
+		{
+			name:    "backup",
+			args:    "[file|dir]",
+			summary: "Save the programs of the thermostats, to a timestamped file by default.",
+			maxArgs: 1,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				var path string
+				if len(args) > 0 {
+					path = args[0]
+				}
+				path, err := app.BackupContext(ctx, cfg, path, slog.Default())
+				if err == nil {
+					slog.Info("Backed up the thermostat programs", "path", path)
+				}
+				return err
+			},
+		},
+		{
+			name:    "restore",
+			args:    "<file>",
+			summary: "Put back the programs saved by backup, from their state_data, or from their program without it.",
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(ctx context.Context, cfg config.Config, args []string) error {
+				return app.RestoreContext(ctx, cfg, args[0], slog.Default(), *dryRun)
+			},
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns the flags of the command, which are the shared ones.
+func (c *command) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+		flags.Lookup(f.Name).DefValue = f.DefValue
+	})
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %v %v [flags] %v\n\n%v\n\nFlags:\n", os.Args[0], c.name, c.args, c.summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %v [flags] [command] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-9v %v\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nRun '%v <command> -h' for the usage of a command.\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"thermostat-scheduler/internal/app"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/fake"
 )
 
-var verbose = flag.Bool("v", false, "whether to print verbose output")
+// The flags are shared by all the commands, and can be given before or after
+// the command's name.
+var verbose = flag.Bool("v", false, "whether to print verbose output; the same as -log-level debug")
 var dryRun = flag.Bool("n", false, "whether to do a dry-run and avoid making any changes to the thermostat program")
 
 var configFile = flag.String("config", "",
 	"location of the config file; default ~/.config/thermostat-scheduler/config.yaml")
 
+var fakeThermostat = flag.Bool("fake-thermostat", false,
+	"whether to use a local fake of the BlueLink API, whose thermostats start with their normal program")
+
+var logFormat = flag.String("log-format", "text", "format of the logs, text or json")
+var logLevel = flag.String("log-level", "info", "lowest level to log: debug, info, warn or error")
+
 func getUserHomeDir() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -30,15 +46,135 @@ func getConfigFileLocation() string {
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
+	// Without a command, run as before there were commands.
+	name := "run"
+	var args []string
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(app.ExitFailure)
+	}
+	flags := cmd.flagSet()
+	flags.Parse(args)
+	if flags.NArg() < cmd.minArgs || flags.NArg() > cmd.maxArgs {
+		flags.Usage()
+		os.Exit(app.ExitFailure)
+	}
+
+	logger, err := newLogger()
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flags.Usage()
+		os.Exit(app.ExitFailure)
+	}
+	// Also for what's still logged with the log package.
+	slog.SetDefault(logger)
+
+	// Stop on SIGTERM or Ctrl-C, without interrupting a program that is
+	// being written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var cfg config.Config
+	if !cmd.withoutConfig {
+		if cfg, err = readConfig(); err != nil {
+			logger.Error(err.Error())
+			os.Exit(app.ExitFailure)
+		}
+		if *fakeThermostat {
+			var closeFake func()
+			if cfg, closeFake, err = withFakeThermostat(cfg); err != nil {
+				logger.Error(err.Error())
+				os.Exit(app.ExitFailure)
+			}
+			defer closeFake()
+		}
+	}
+
+	if err := cmd.run(ctx, cfg, flags.Args()); err != nil {
+		logger.Error(err.Error(), "exit_code", app.ExitCode(err))
+		stop()
+		os.Exit(app.ExitCode(err))
+	}
+}
+
+// Returns the logger that the flags ask for, which writes to stderr.
+func newLogger() (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level: %w", err)
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q, expected text or json", *logFormat)
+}
+
+func readConfig() (config.Config, error) {
 	configFile, err := os.Open(getConfigFileLocation())
 	if err != nil {
-		log.Fatal(err)
+		return config.Config{}, err
+	}
+	defer configFile.Close()
+	cfg, err := config.ReadConfig(configFile)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Starts a local fake of the BlueLink API, to try the config without touching
+// the actual thermostats, and returns |cfg| pointed at it along with a func to
+// stop it.
+func withFakeThermostat(cfg config.Config) (config.Config, func(), error) {
+	bluelink, err := fake.NewBlueLinkFor(cfg)
+	if err != nil {
+		return cfg, nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return cfg, nil, fmt.Errorf("failed to start the fake thermostat: %w", err)
 	}
+	server := &http.Server{Handler: bluelink}
+	go server.Serve(listener)
+
+	cfg.BlueLinkUrl = "http://" + listener.Addr().String() + "/"
+	cfg.FakeThermostat = true
+	slog.Info("Using a fake thermostat", "url", cfg.BlueLinkUrl)
+	return cfg, func() { server.Close() }, nil
+}
+
+// Serves the metrics on /metrics at |address|, and returns a func to stop.
+func serveMetrics(address string) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.Metrics)
+	return serve(address, "/metrics", "metrics", mux)
+}
 
-	err = app.Run(configFile, *verbose, *dryRun)
+// Serves |handler| at |address|, logging the URL of |path| as where |what| is,
+// and returns a func to stop.
+func serve(address, path, what string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to serve the %v: %w", what, err)
 	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+
+	slog.Info("Serving the "+what, "url", "http://"+listener.Addr().String()+path)
+	return func() { server.Close() }, nil
 }
@@ -1,8 +1,11 @@
 module thermostat-scheduler
 
-go 1.18
+go 1.21
 
 require (
 	github.com/google/go-cmp v0.6.0
+	golang.org/x/term v0.15.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require golang.org/x/sys v0.15.0 // indirect
@@ -11,15 +11,16 @@ type AuthenticationKey struct {
 
 type Device struct {
 	UUID      string    `json:"uuid"` // The device identifier.
+	Name      string    `json:"name"` // The name given to the device in the app.
 	StateData StateData `json:"state_data"`
 }
 
 type StateData struct {
-	Program1 string `json:"PGM_01"` // Monday
-	Program2 string `json:"PGM_02"` // Tuesday
-	Program3 string `json:"PGM_03"` // Wednesday
-	Program4 string `json:"PGM_04"` // Thursday
-	Program5 string `json:"PGM_05"` // Friday
-	Program6 string `json:"PGM_06"` // Saturday
-	Program7 string `json:"PGM_07"` // Sunday
+	Program1 string `json:"PGM_01" yaml:"PGM_01"` // Monday
+	Program2 string `json:"PGM_02" yaml:"PGM_02"` // Tuesday
+	Program3 string `json:"PGM_03" yaml:"PGM_03"` // Wednesday
+	Program4 string `json:"PGM_04" yaml:"PGM_04"` // Thursday
+	Program5 string `json:"PGM_05" yaml:"PGM_05"` // Friday
+	Program6 string `json:"PGM_06" yaml:"PGM_06"` // Saturday
+	Program7 string `json:"PGM_07" yaml:"PGM_07"` // Sunday
 }
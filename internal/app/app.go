@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"thermostat-scheduler/internal/api"
 	"thermostat-scheduler/internal/client"
 	"thermostat-scheduler/internal/config"
 	"thermostat-scheduler/internal/events"
@@ -14,63 +18,301 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
-func Run(configReader io.Reader, verbose, dryRun bool) error {
+func Run(configReader io.Reader, logger *slog.Logger, dryRun bool) error {
+	return RunContext(context.Background(), configReader, logger, dryRun)
+}
+
+// Like Run, but stops when |ctx| is done. A thermostat that is being updated
+// when |ctx| is done still gets its whole program, so that it's never left
+// with part of it, but the thermostats after it aren't updated.
+func RunContext(ctx context.Context, configReader io.Reader, logger *slog.Logger, dryRun bool) error {
 	cfg, err := config.ReadConfig(configReader)
 	if err != nil {
 		return fmt.Errorf("failed to read config: %w", err)
 	}
+	return RunWithConfig(ctx, cfg, logger, dryRun)
+}
 
-	events, err := events.GetPeakEvents(cfg.PeakEventsUrl, verbose)
+// Like RunContext, but with a config that was already read. Everything that
+// is logged to |logger| during the run has the same run_id.
+func RunWithConfig(ctx context.Context, cfg config.Config, logger *slog.Logger, dryRun bool) error {
+	logger = logger.With("run_id", newRunID())
+	restoreLastSuccess(logger)
+	defer writeMetrics(cfg, logger)
+	peakEvents, err := fetchEvents(ctx, cfg, logger)
 	if err != nil {
 		return fmt.Errorf("failed to get peak events: %w", err)
 	}
+	return programThermostats(ctx, cfg, peakEvents, time.Now(), logger, dryRun)
+}
 
-	// Based on the config and the list of peak events, assemble a program for
-	// the current week.
-	wp := program.AssembleProgram(cfg, time.Now(), events, verbose)
-	newStateData := wp.ToStateData()
+// Returns a random ID to tell the logs of a run apart from the others.
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-	apiClient := client.New()
-	err = apiClient.Login(cfg.Username, cfg.Password)
+// Fetches the peak events of |cfg|, and records what's coming. When they
+// can't be fetched, the ones fetched before and the forced ones are used
+// instead, if there are any, so that the forced ones are still programmed
+// without losing the others.
+func fetchEvents(ctx context.Context, cfg config.Config, logger *slog.Logger) ([]events.PeakEvent, error) {
+	peakEvents, err := events.GetPeakEventsContext(ctx, cfg.PeakEventsUrl, cfg.Retry, !cfg.FakeThermostat, logger)
+	if err != nil && len(peakEvents) == 0 {
+		return nil, err
+	}
 	if err != nil {
-		log.Fatal(err)
+		logger.Warn("Using the peak events fetched before, and the forced ones", "err", err)
 	}
+	recordEvents(peakEvents, err == nil, time.Now())
+	return peakEvents, nil
+}
 
-	devices, err := apiClient.Devices()
+// Programs each thermostat of |cfg| in turn for |peakEvents|. A failure on one
+// of them is reported, but doesn't prevent programming the others.
+func programThermostats(ctx context.Context, cfg config.Config, peakEvents []events.PeakEvent, now time.Time,
+	logger *slog.Logger, dryRun bool) error {
+	apiClient, devices, err := connect(ctx, cfg, logger)
 	if err != nil {
-		return fmt.Errorf("failed to get list of devices: %w", err)
+		return err
+	}
+
+	failed := 0
+	var firstErr error
+	for _, t := range cfg.Thermostats {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before programming %v: %w", t, err)
+		}
+		tlog := logger.With("thermostat", t.String())
+		device, err := findDevice(devices, t, tlog)
+		if err == nil {
+			tlog = tlog.With("device", device.UUID)
+			err = programThermostat(ctx, apiClient, cfg.ForThermostat(t), device, now, peakEvents, tlog, dryRun)
+		}
+		if err == nil {
+			continue
+		}
+
+		var offline *client.DeviceOfflineError
+		var rejected *client.ValidationError
+		switch {
+		case errors.As(err, &offline):
+			tlog.Warn("Thermostat is offline, its program will be updated on the next run", "err", err)
+		case errors.As(err, &rejected):
+			tlog.Error("Thermostat rejected its program, check its configuration", "err", err)
+		default:
+			tlog.Error("Failed to program thermostat", "err", err)
+		}
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to program %v of %v thermostats: %w", failed, len(cfg.Thermostats), firstErr)
+	}
+	recordSuccess(time.Now(), !cfg.FakeThermostat, logger)
+	return nil
+}
+
+// The exit codes for the failures that are worth telling apart, e.g., to
+// alert on bad credentials but not on a thermostat that's offline.
+const (
+	ExitFailure        = 1 // Any other failure.
+	ExitUnauthorized   = 2 // The credentials were rejected.
+	ExitRateLimited    = 3 // The BlueLink API asked to slow down.
+	ExitDeviceOffline  = 4 // A thermostat is offline.
+	ExitRejected       = 5 // A program was rejected as invalid.
+	ExitServerError    = 6 // The BlueLink API failed.
+	ExitNotApplied     = 7 // A thermostat didn't take its program, and its previous one was restored.
+	ExitRollbackFailed = 8 // A thermostat didn't take its program, nor its previous one.
+)
+
+// Returns the exit code for |err|, as returned by Run.
+func ExitCode(err error) int {
+	var unauthorized *client.UnauthorizedError
+	var rateLimited *client.RateLimitedError
+	var offline *client.DeviceOfflineError
+	var rejected *client.ValidationError
+	var serverError *client.ServerError
+	var mismatch *VerificationError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &mismatch):
+		if mismatch.RolledBack {
+			return ExitNotApplied
+		}
+		return ExitRollbackFailed
+	case errors.As(err, &unauthorized):
+		return ExitUnauthorized
+	case errors.As(err, &rateLimited):
+		return ExitRateLimited
+	case errors.As(err, &offline):
+		return ExitDeviceOffline
+	case errors.As(err, &rejected):
+		return ExitRejected
+	case errors.As(err, &serverError):
+		return ExitServerError
+	}
+	return ExitFailure
+}
+
+// Logs in to the BlueLink API of |cfg|, and returns the client along with the
+// devices of the account.
+func connect(ctx context.Context, cfg config.Config, logger *slog.Logger) (*client.Client, []api.Device, error) {
+	apiClient, err := newClient(cfg, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = apiClient.LoginContext(ctx, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to login, check the username and password: %w", err)
+	}
+
+	devices, err := apiClient.DevicesContext(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get list of devices: %w", err)
 	}
 
 	if len(devices) < 1 {
-		return errors.New("expected one device, found none")
+		return nil, nil, errors.New("expected at least one device, found none")
 	}
+	return apiClient, devices, nil
+}
 
-	if len(devices) > 1 {
-		log.Println("Expected exactly one device, but found ", devices, ". Using the first one.")
+// Returns a client for the BlueLink API of |cfg|, which keeps its session
+// token between runs, unless it's a fake.
+func newClient(cfg config.Config, logger *slog.Logger) (*client.Client, error) {
+	baseURL := cfg.BlueLinkUrl
+	if baseURL == "" {
+		baseURL = client.DefaultBaseURL
 	}
-	device := devices[0]
+	apiClient, err := client.NewWithBaseURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	apiClient.UseRetryPolicy(cfg.Retry)
+	apiClient.ObserveErrors(func(endpoint string, err error) {
+		apiErrors.Inc(endpoint)
+	})
+	if cfg.FakeThermostat {
+		return apiClient, nil
+	}
+	tokens, err := client.NewFileTokenStore(baseURL, cfg.Username)
+	if err != nil {
+		logger.Warn("Not keeping the session token between runs", "err", err)
+	} else {
+		apiClient.UseTokenStore(tokens)
+	}
+	return apiClient, nil
+}
 
-	if device.StateData == newStateData {
-		if verbose {
-			log.Println("No changes required to the thermostat program.")
+// Returns the device that |t| matches.
+func findDevice(devices []api.Device, t config.Thermostat, logger *slog.Logger) (api.Device, error) {
+	var matches []api.Device
+	for _, d := range devices {
+		if t.Matches(d) {
+			matches = append(matches, d)
 		}
-		return nil
 	}
+	if len(matches) < 1 {
+		return api.Device{}, fmt.Errorf("no device matches %v", t)
+	}
+	if len(matches) > 1 {
+		logger.Warn("Expected exactly one device, using the first one", "devices", len(matches), "device", matches[0].UUID)
+	}
+	return matches[0], nil
+}
 
-	currentprogram := config.ToWeeklyProgram(device.StateData)
-	nextProgram := config.ToWeeklyProgram(newStateData)
+// The longest to wait for a thermostat's program to be written, including
+// retries, verification and rollback, once it was started.
+const writeTimeout = 5 * time.Minute
+
+// Assembles the program of the thermostat that |cfg| is for, and updates
+// |device| with it if it differs from the device's current program.
+func programThermostat(ctx context.Context, apiClient *client.Client, cfg config.Config, device api.Device, now time.Time,
+	peakEvents []events.PeakEvent, logger *slog.Logger, dryRun bool) error {
+	newStateData, err := planThermostat(cfg, now, peakEvents, logger, dryRun)
+	if err != nil {
+		return err
+	}
+	return applyProgram(ctx, apiClient, cfg, device, newStateData, logger, dryRun)
+}
 
-	diff := cmp.Diff(currentprogram, nextProgram)
+// Based on the config and the list of peak events, assembles a program for
+// the current week for the thermostat that |cfg| is for, fitted to its
+// capabilities. What had to change for it to fit is logged at the debug level,
+// or at the info level when |report|.
+func planThermostat(cfg config.Config, now time.Time, peakEvents []events.PeakEvent, logger *slog.Logger,
+	report bool) (api.StateData, error) {
+	wp, dropped := program.AssembleProgram(cfg, now, peakEvents, logger)
+	stateData, adjustments, err := wp.ToStateData(cfg.Units, cfg.DeviceUnits, cfg.Device)
+	if err != nil {
+		return api.StateData{}, fmt.Errorf("failed to convert program for the thermostat: %w", err)
+	}
+	recordPlan(cfg.Thermostats[0], config.ToWeeklyProgram(stateData, cfg.DeviceUnits, cfg.Units))
 
-	log.Printf("The thermostat program differs from the one that was computed:\n%v", diff)
+	// Report the parts of the intended program that didn't fit in the
+	// thermostat's periods, and what was rounded to fit its capabilities.
+	level := slog.LevelDebug
+	if report {
+		level = slog.LevelInfo
+	}
+	for _, d := range dropped {
+		logger.Log(context.Background(), level, "Could not represent in the program", "dropped", d.String(), "units", cfg.Units.Symbol())
+	}
+	for _, a := range adjustments {
+		logger.Log(context.Background(), level, "Adjusted for the thermostat", "adjustment", a.String())
+	}
+	return stateData, nil
+}
+
+// Updates |device| with |newStateData| if it differs from the device's current
+// program, showing the diff. When the thermostat doesn't take it, its previous
+// program is restored.
+func applyProgram(ctx context.Context, apiClient *client.Client, cfg config.Config, device api.Device,
+	newStateData api.StateData, logger *slog.Logger, dryRun bool) error {
+	if device.StateData == newStateData {
+		logger.Debug("No changes required to the thermostat program")
+		return nil
+	}
+
+	diff := programDiff(cfg, device.StateData, newStateData)
+	logger.Info("The thermostat program differs from the one that was computed", "units", cfg.Units.Symbol(), "diff", diff)
 	if dryRun {
-		log.Println("Dry-run; exiting early without any modifications.")
+		logger.Info("Dry-run; exiting early without any modifications")
 		return nil
 	}
 
-	_, err = apiClient.SetDeviceAttributes(device.UUID, newStateData)
-	if err != nil {
-		return fmt.Errorf("failed to update device schedule: %w", err)
+	// Finish writing the program even if |ctx| is done in the meantime, so
+	// that the thermostat isn't left with part of it.
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), writeTimeout)
+	defer cancel()
+	err := writeAndVerify(writeCtx, apiClient, device.UUID, newStateData, logger)
+
+	// When the thermostat doesn't take the new program, put back the one it
+	// had, rather than leaving it with a mix of both.
+	if err == nil {
+		programChanges.Inc(cfg.Thermostats[0].String())
 	}
-	return nil
+	var mismatch *VerificationError
+	if errors.As(err, &mismatch) {
+		logger.Warn("Restoring the previous program", "err", err)
+		if rollbackErr := writeAndVerify(writeCtx, apiClient, device.UUID, device.StateData, logger); rollbackErr != nil {
+			logger.Error("Failed to restore the previous program", "err", rollbackErr)
+		} else {
+			mismatch.RolledBack = true
+		}
+	}
+	return err
+}
+
+// Returns the diff from |current| to |next|, in the configured units so that
+// it can be compared with the config.
+func programDiff(cfg config.Config, current, next api.StateData) string {
+	currentProgram := config.ToWeeklyProgram(current, cfg.DeviceUnits, cfg.Units)
+	nextProgram := config.ToWeeklyProgram(next, cfg.DeviceUnits, cfg.Units)
+	return cmp.Diff(currentProgram, nextProgram)
 }
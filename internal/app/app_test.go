@@ -0,0 +1,244 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/client"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/fake"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("failed"), ExitFailure},
+		{fmt.Errorf("failed to login: %w", &client.UnauthorizedError{}), ExitUnauthorized},
+		{fmt.Errorf("failed to program 1 of 2 thermostats: %w", &client.DeviceOfflineError{}), ExitDeviceOffline},
+		{&client.RateLimitedError{}, ExitRateLimited},
+		{&client.ValidationError{}, ExitRejected},
+		{&client.ServerError{}, ExitServerError},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("for %v, want %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+// Returns a config for |bluelink| and the events of |peakEvents|.
+func testConfig(t *testing.T, bluelink *fake.BlueLink, peakEvents string) config.Config {
+	t.Helper()
+	// Keep the seen events and session tokens out of the user's cache.
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	// Don't wait before reading the programs back, for this test only.
+	delay := verifyDelay
+	verifyDelay = 0
+	t.Cleanup(func() { verifyDelay = delay })
+
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, peakEvents)
+	}))
+	t.Cleanup(events.Close)
+	server := httptest.NewServer(bluelink)
+	t.Cleanup(server.Close)
+
+	cfg, err := config.ReadConfig(strings.NewReader(`
+username: user
+password: password
+peak_events_url: "` + events.URL + `"
+bluelink_url: "` + server.URL + `/"
+normal_program:
+  sunday: &default_program
+    morning: { time: 7h, heat: 21, cool: 24 }
+    day:     { time: 9h, heat: 20, cool: 24 }
+    evening: { time: 16h, heat: 21, cool: 24 }
+    night:   { time: 21h, heat: 20, cool: 25 }
+  monday: *default_program
+  tuesday: *default_program
+  wednesday: *default_program
+  thursday: *default_program
+  friday: *default_program
+  saturday: *default_program
+peak_program:
+  pre_heat_duration: 1h
+  pre_heat_temp_offset: 2
+  peak_temp_offset: -2
+retry:
+  initial_backoff: 1ms
+  max_backoff: 1ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// Returns the JSON of a peak event tomorrow morning, from 6h to 9h.
+func tomorrowMorningEvent() string {
+	now := time.Now()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	return fmt.Sprintf(`[{"datedebut": %q, "datefin": %q, "offre": "CPC-D"}]`,
+		tomorrow.Add(6*time.Hour).Format(time.RFC3339), tomorrow.Add(9*time.Hour).Format(time.RFC3339))
+}
+
+func normalStateData(t *testing.T, cfg config.Config) api.StateData {
+	t.Helper()
+	sd, _, err := cfg.NormalProgram.ToStateData(cfg.Units, cfg.DeviceUnits, cfg.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+func TestRunWithConfig(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", Name: "Home", StateData: normal})
+	ctx := context.Background()
+
+	// A dry-run doesn't change the thermostat.
+	if err := RunWithConfig(ctx, cfg, slog.Default(), true); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the dry-run to leave the program alone, got %v", d.StateData)
+	}
+
+	// A run programs tomorrow's peak event.
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	programmed, _ := bluelink.Device("abc")
+	if programmed.StateData == normal {
+		t.Errorf("expected the program to change")
+	}
+
+	// Running again uses the saved session token, and has nothing to change.
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := bluelink.Calls(fake.LoginEndpoint); n != 1 {
+		t.Errorf("expected a single login, got %v", n)
+	}
+	if n := bluelink.Calls(fake.SetStateAttrEndpoint); n != 1 {
+		t.Errorf("expected a single update, got %v", n)
+	}
+
+	// An expired session and transient failures are recovered from.
+	bluelink.ExpireTokens()
+	bluelink.Fail(fake.Failure{Endpoint: fake.DevicesEndpoint, Status: http.StatusServiceUnavailable}, 1)
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := bluelink.Calls(fake.LoginEndpoint); n != 2 {
+		t.Errorf("expected to login again, got %v logins", n)
+	}
+}
+
+func TestRunWithFakeThermostat(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	cfg.FakeThermostat = true
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normalStateData(t, cfg)})
+
+	// Neither the session token, the events already seen nor the last
+	// success of the actual thermostats are touched.
+	for i := 0; i < 2; i++ {
+		if err := RunWithConfig(context.Background(), cfg, slog.Default(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := bluelink.Calls(fake.LoginEndpoint); n != 2 {
+		t.Errorf("expected to login on every run, got %v logins", n)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _ := filepath.Glob(filepath.Join(cacheDir, "thermostat-scheduler", "*"))
+	for _, path := range kept {
+		if name := filepath.Base(path); strings.HasPrefix(name, "token-") || name == "seen_events" || name == "last_success" {
+			t.Errorf("expected %v not to be kept", path)
+		}
+	}
+}
+
+func TestRunWithConfigFailures(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", Name: "Upstairs", StateData: normal})
+	bluelink.AddDevice(api.Device{UUID: "def", Name: "Downstairs", StateData: normal})
+	cfg.Thermostats = []config.Thermostat{
+		cfg.Thermostats[0], cfg.Thermostats[0],
+	}
+	cfg.Thermostats[0].Name = "Upstairs"
+	cfg.Thermostats[1].Name = "Downstairs"
+	ctx := context.Background()
+
+	// An offline thermostat doesn't prevent updating the others.
+	bluelink.SetOffline("abc", true)
+	err := RunWithConfig(ctx, cfg, slog.Default(), false)
+	if ExitCode(err) != ExitDeviceOffline {
+		t.Errorf("expected the thermostat to be offline, got %v", err)
+	}
+	if d, _ := bluelink.Device("def"); d.StateData == normal {
+		t.Errorf("expected the other thermostat to be programmed")
+	}
+
+	// Bad credentials are reported as such.
+	cfg.Password = "wrong"
+	bluelink.ExpireTokens()
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); ExitCode(err) != ExitUnauthorized {
+		t.Errorf("expected the credentials to be rejected, got %v", err)
+	}
+}
+
+func TestRunWithConfigVerification(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	ctx := context.Background()
+
+	// A program that doesn't stick is written again.
+	bluelink.DropWrites("abc", 1)
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	programmed, _ := bluelink.Device("abc")
+	if programmed.StateData == normal || bluelink.Calls(fake.SetStateAttrEndpoint) != 2 {
+		t.Errorf("expected the program to be written twice")
+	}
+
+	// When it keeps not sticking, the previous program is restored. Since
+	// the device ignores the writes, it still has it.
+	bluelink.AddDevice(api.Device{UUID: "def", StateData: normal})
+	cfg.Thermostats[0].UUID = "def"
+	bluelink.DropWrites("def", verifyAttempts)
+	err := RunWithConfig(ctx, cfg, slog.Default(), false)
+	if ExitCode(err) != ExitNotApplied {
+		t.Errorf("expected the previous program to be restored, got %v", err)
+	}
+	if d, _ := bluelink.Device("def"); d.StateData != normal {
+		t.Errorf("expected the previous program, got %v", d.StateData)
+	}
+	var mismatch *VerificationError
+	if !errors.As(err, &mismatch) || len(mismatch.Mismatched) != 1 {
+		t.Errorf("expected a single mismatched program, got %v", err)
+	}
+}
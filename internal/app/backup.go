@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/client"
+	"thermostat-scheduler/internal/config"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A snapshot of the programs of the thermostats on the account.
+type Backup struct {
+	Time    time.Time      `yaml:"time" json:"time"`
+	Devices []DeviceBackup `yaml:"devices" json:"devices"`
+}
+
+// The program of a single thermostat, in its own units to be read, and as the
+// thermostat has it, so that restoring it gives back the exact same program.
+// StateData is what's restored, and Program only when StateData is empty.
+type DeviceBackup struct {
+	UUID      string               `yaml:"uuid" json:"uuid"`
+	Name      string               `yaml:"name" json:"name"`
+	Units     config.Units         `yaml:"units" json:"units"`
+	Program   config.WeeklyProgram `yaml:"program" json:"program"`
+	StateData api.StateData        `yaml:"state_data" json:"state_data"`
+}
+
+// Writes the programs of the thermostats on the account to |path|, as JSON if
+// it ends with ".json" and as YAML otherwise. When |path| is empty or a
+// directory, the backup is written to a timestamped file in it. Returns the
+// path of the backup.
+func BackupContext(ctx context.Context, cfg config.Config, path string, logger *slog.Logger) (string, error) {
+	_, devices, err := connect(ctx, cfg, logger)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	backup := Backup{Time: now.Truncate(time.Second)}
+	for _, d := range devices {
+		units := thermostatFor(cfg, d).DeviceUnits
+		backup.Devices = append(backup.Devices, DeviceBackup{
+			UUID:      d.UUID,
+			Name:      d.Name,
+			Units:     units,
+			Program:   config.ToWeeklyProgram(d.StateData, units, units),
+			StateData: d.StateData,
+		})
+	}
+
+	if info, err := os.Stat(path); path == "" || (err == nil && info.IsDir()) {
+		path = filepath.Join(path, "thermostat-backup-"+now.Format("20060102-150405")+".yaml")
+	}
+	var data []byte
+	if strings.HasSuffix(path, ".json") {
+		data, err = json.MarshalIndent(backup, "", "  ")
+	} else {
+		data, err = yaml.Marshal(backup)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode backup: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	return path, nil
+}
+
+// Reads the backup at |path|, in the format that BackupContext writes.
+func ReadBackup(path string) (Backup, error) {
+	var backup Backup
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return backup, err
+	}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &backup)
+	} else {
+		err = yaml.Unmarshal(data, &backup)
+	}
+	if err != nil {
+		return backup, fmt.Errorf("failed to decode backup: %w", err)
+	}
+	return backup, nil
+}
+
+// Pushes the programs of the backup at |path| back to the thermostats they
+// were taken from, with the same diff, dry-run and verification as a run.
+func RestoreContext(ctx context.Context, cfg config.Config, path string, logger *slog.Logger, dryRun bool) error {
+	backup, err := ReadBackup(path)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	apiClient, devices, err := connect(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	var firstErr error
+	for _, b := range backup.Devices {
+		err := restoreDevice(ctx, apiClient, cfg, devices, b, logger.With("device", b.UUID), dryRun)
+		if err != nil {
+			logger.Error("Failed to restore thermostat", "device", b.UUID, "err", err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to restore %v of %v thermostats: %w", failed, len(backup.Devices), firstErr)
+	}
+	return nil
+}
+
+func restoreDevice(ctx context.Context, apiClient *client.Client, cfg config.Config, devices []api.Device,
+	b DeviceBackup, logger *slog.Logger, dryRun bool) error {
+	var device *api.Device
+	for i := range devices {
+		if devices[i].UUID == b.UUID {
+			device = &devices[i]
+		}
+	}
+	if device == nil {
+		return fmt.Errorf("no device with uuid %v", b.UUID)
+	}
+
+	t := thermostatFor(cfg, *device)
+	stateData := b.StateData
+	if stateData != (api.StateData{}) && config.ToWeeklyProgram(stateData, b.Units, b.Units) != b.Program {
+		logger.Warn("The backup's program differs from its state_data, which is what's restored. " +
+			"Remove state_data to restore the program instead")
+	}
+	// Backups without the thermostat's own program have it converted back,
+	// which may round it. The capabilities of the thermostat are in the
+	// config's units.
+	if stateData == (api.StateData{}) {
+		program := b.Program.Convert(b.Units, cfg.Units)
+		var err error
+		stateData, _, err = program.ToStateData(cfg.Units, t.DeviceUnits, t.Device)
+		if err != nil {
+			return fmt.Errorf("failed to convert program for the thermostat: %w", err)
+		}
+	}
+	return applyProgram(ctx, apiClient, cfg.ForThermostat(t), *device, stateData, logger.With("thermostat", t.String()), dryRun)
+}
+
+// Returns the thermostat of |cfg| that matches |d|, or one with the
+// top-level settings and |d|'s identity when none does.
+func thermostatFor(cfg config.Config, d api.Device) config.Thermostat {
+	for _, t := range cfg.Thermostats {
+		if (t.UUID != "" || t.Name != "") && t.Matches(d) {
+			return t
+		}
+	}
+	return config.Thermostat{
+		UUID:        d.UUID,
+		Name:        d.Name,
+		DeviceUnits: cfg.DeviceUnits,
+		Device:      cfg.Device,
+	}
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/fake"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", Name: "Home", StateData: normal})
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A backup to a directory gets a timestamped name.
+	yamlPath, err := BackupContext(ctx, cfg, dir, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(yamlPath) != dir || !strings.HasPrefix(filepath.Base(yamlPath), "thermostat-backup-") {
+		t.Errorf("expected a timestamped backup in %v, got %v", dir, yamlPath)
+	}
+	jsonPath, err := BackupContext(ctx, cfg, filepath.Join(dir, "backup.json"), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := ReadBackup(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Devices) != 1 || backup.Devices[0].UUID != "abc" || backup.Devices[0].Name != "Home" {
+		t.Errorf("expected a backup of the device, got %+v", backup)
+	}
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+			t.Fatal(err)
+		}
+		programmed, _ := bluelink.Device("abc")
+		if programmed.StateData == normal {
+			t.Fatalf("expected the program to change")
+		}
+
+		// A dry-run doesn't change the thermostat.
+		if err := RestoreContext(ctx, cfg, path, slog.Default(), true); err != nil {
+			t.Fatal(err)
+		}
+		if d, _ := bluelink.Device("abc"); d.StateData != programmed.StateData {
+			t.Errorf("expected the dry-run to leave the program alone, got %v", d.StateData)
+		}
+
+		if err := RestoreContext(ctx, cfg, path, slog.Default(), false); err != nil {
+			t.Fatal(err)
+		}
+		if d, _ := bluelink.Device("abc"); d.StateData != normal {
+			t.Errorf("expected %v to restore\n%v, got\n%v", path, normal, d.StateData)
+		}
+	}
+
+	if err := RestoreContext(ctx, cfg, filepath.Join(dir, "missing.yaml"), slog.Default(), false); err == nil {
+		t.Errorf("expected a missing backup to fail")
+	}
+}
+
+func TestRestoreIsExact(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	ctx := context.Background()
+
+	// A program that the scheduler wouldn't write itself, off the time step
+	// of the thermostat.
+	offStep := cfg
+	offStep.Device.TimeStep = 5 * time.Minute
+	offStep.NormalProgram.Monday.Morning.Time = 7*time.Hour + 5*time.Minute
+	original := normalStateData(t, offStep)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: original})
+
+	path, err := BackupContext(ctx, cfg, filepath.Join(t.TempDir(), "backup.yaml"), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreContext(ctx, cfg, path, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != original {
+		t.Errorf("expected the exact program back\n%v, got\n%v", original, d.StateData)
+	}
+
+	// An edited program is only restored without the thermostat's own one,
+	// which otherwise wins, with a warning.
+	backup, err := ReadBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBackup := func(backup Backup) {
+		t.Helper()
+		data, err := yaml.Marshal(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup.Devices[0].Program.Monday.Morning.Heat = 18
+	writeBackup(backup)
+	var logs strings.Builder
+	if err := RestoreContext(ctx, cfg, path, slog.New(slog.NewTextHandler(&logs, nil)), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != original || !strings.Contains(logs.String(), "differs from its state_data") {
+		t.Errorf("expected the exact program back with a warning, got\n%v\n%v", d.StateData, logs.String())
+	}
+
+	// Backups from before the thermostat's own program was kept are
+	// converted back, fitted to the time step.
+	backup.Devices[0].Program.Monday.Morning.Heat = 21
+	backup.Devices[0].StateData = api.StateData{}
+	writeBackup(backup)
+	if err := RestoreContext(ctx, cfg, path, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normalStateData(t, cfg) {
+		t.Errorf("expected the program fitted to the time step, got\n%v", d.StateData)
+	}
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"time"
+)
+
+// How long after an event ends, or after midnight, to update the programs, so
+// that the thermostats are past the change.
+const settleDelay = time.Minute
+
+// How long to wait before trying again after a failed update. It doubles with
+// every failure in a row, up to the refresh interval.
+const minFailureBackoff = time.Minute
+
+// Keeps the thermostats of |cfg| programmed until |ctx| is done. Refreshes the
+// peak events every refresh interval, and updates the programs whenever they
+// must change: before pre-heating starts, after an event ends, and after
+// midnight. Failures are logged and retried, and a value on |reload| updates
+// the config with |reloadConfig|. Each update is logged with its own run_id.
+func DaemonContext(ctx context.Context, cfg config.Config, reloadConfig func() (config.Config, error),
+	reload <-chan os.Signal, logger *slog.Logger, dryRun bool) error {
+	logger.Info("Running as a daemon", "refresh_interval", cfg.Daemon.RefreshInterval)
+	restoreLastSuccess(logger)
+
+	// The events of the last refresh, to keep following them when they can't
+	// be refreshed. Until they are first fetched, the programs are left alone
+	// rather than losing the events that a previous run programmed.
+	var peakEvents []events.PeakEvent
+	fetchedEvents := false
+	failures := 0
+	for {
+		failed := false
+		runLogger := logger.With("run_id", newRunID())
+		fetched, err := fetchEvents(ctx, cfg, runLogger)
+		if err != nil {
+			runLogger.Error("Failed to refresh the peak events", "err", err)
+			failed = true
+		} else {
+			peakEvents, fetchedEvents = fetched, true
+		}
+		if fetchedEvents {
+			if err := programThermostats(ctx, cfg, peakEvents, time.Now(), runLogger, dryRun); err != nil {
+				runLogger.Error("Failed to update the programs", "err", err)
+				failed = true
+			}
+		}
+		writeMetrics(cfg, runLogger)
+		if ctx.Err() != nil {
+			logger.Info("Daemon stopped")
+			return nil
+		}
+
+		now := time.Now()
+		wake := nextWake(cfg, peakEvents, now)
+		if failed {
+			failures++
+			if retry := now.Add(failureBackoff(failures, cfg.Daemon.RefreshInterval)); retry.Before(wake) {
+				wake = retry
+			}
+		} else {
+			failures = 0
+		}
+		runLogger.Debug("Next update", "at", wake, "failures", failures)
+
+		timer := time.NewTimer(wake.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Info("Daemon stopped")
+			return nil
+		case <-reload:
+			timer.Stop()
+			reloaded, err := reloadConfig()
+			if err != nil {
+				logger.Error("Failed to reload the config, keeping the previous one", "err", err)
+			} else {
+				logger.Info("Reloaded the config")
+				cfg = reloaded
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// Returns when to update the programs next after |now|: just before
+// pre-heating starts for an upcoming event, to make sure the thermostats have
+// its latest program, just after an event ends, to take it out of the program
+// before it comes back next week, and just after midnight, when the program
+// moves on to a new day. In between, the events are refreshed every refresh
+// interval.
+func nextWake(cfg config.Config, peakEvents []events.PeakEvent, now time.Time) time.Time {
+	next := now.Add(cfg.Daemon.RefreshInterval)
+	consider := func(t time.Time) {
+		if t.After(now) && t.Before(next) {
+			next = t
+		}
+	}
+
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	consider(tomorrow.Add(settleDelay))
+	for _, e := range peakEvents {
+		if e.Skipped {
+			continue
+		}
+		for _, t := range cfg.Thermostats {
+			pp := t.PeakProgram
+			lead := pp.PreHeatDuration
+			if pp.IsCoolingEvent(e.Offer, e.Start) {
+				lead = pp.PreCoolDuration
+			}
+			consider(e.Start.Add(-lead - cfg.Daemon.WakeBefore))
+			consider(e.End.Add(pp.PeakBufferDuration + settleDelay))
+		}
+	}
+	return next
+}
+
+// Returns how long to wait after |failures| failed updates in a row.
+func failureBackoff(failures int, max time.Duration) time.Duration {
+	backoff := minFailureBackoff
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
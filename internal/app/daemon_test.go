@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"syscall"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"thermostat-scheduler/internal/fake"
+	"time"
+)
+
+func TestNextWake(t *testing.T) {
+	cfg := config.Config{
+		Daemon: config.Daemon{RefreshInterval: 6 * time.Hour, WakeBefore: 15 * time.Minute},
+		Thermostats: []config.Thermostat{{
+			PeakProgram: config.PeakProgram{PreHeatDuration: time.Hour, PeakBufferDuration: 2 * time.Minute},
+		}},
+	}
+	day := time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC)
+	event := events.PeakEvent{Start: day.Add(16 * time.Hour), End: day.Add(20 * time.Hour)}
+	peakEvents := []events.PeakEvent{event}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"refresh", day.Add(8 * time.Hour), day.Add(14 * time.Hour)},
+		{"before pre-heating", day.Add(13 * time.Hour), day.Add(14*time.Hour + 45*time.Minute)},
+		{"during pre-heating", day.Add(15 * time.Hour), day.Add(20*time.Hour + 3*time.Minute)},
+		{"after the event", day.Add(21 * time.Hour), day.AddDate(0, 0, 1).Add(time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextWake(cfg, peakEvents, tt.now); !got.Equal(tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// A cooling event is pre-cooled for instead.
+	cfg.Thermostats[0].PeakProgram.PreCoolDuration = 2 * time.Hour
+	cfg.Thermostats[0].PeakProgram.CoolingMonths = []time.Month{time.January}
+	if got, want := nextWake(cfg, peakEvents, day.Add(13*time.Hour)), day.Add(13*time.Hour+45*time.Minute); !got.Equal(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	for failures, want := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		if got := failureBackoff(failures, 5*time.Minute); got != want {
+			t.Errorf("after %v failures, want %v, got %v", failures, want, got)
+		}
+	}
+}
+
+func TestDaemonContext(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+
+	// The reloaded config sets back further during the event.
+	reloaded := cfg
+	reloaded.Thermostats = []config.Thermostat{cfg.Thermostats[0]}
+	reloaded.Thermostats[0].PeakProgram.PeakTempOffset = -3
+	reloadConfig := func() (config.Config, error) {
+		return reloaded, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- DaemonContext(ctx, cfg, reloadConfig, reload, slog.Default(), false)
+	}()
+
+	waitForWrites := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); bluelink.Calls(fake.SetStateAttrEndpoint) < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %v writes, got %v", n, bluelink.Calls(fake.SetStateAttrEndpoint))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The daemon programs the thermostat when it starts, then again with the
+	// reloaded config.
+	waitForWrites(1)
+	first, _ := bluelink.Device("abc")
+	if first.StateData == normal {
+		t.Errorf("expected the program to change")
+	}
+	reload <- syscall.SIGHUP
+	waitForWrites(2)
+	if second, _ := bluelink.Device("abc"); second.StateData == first.StateData {
+		t.Errorf("expected the reloaded config to change the program")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the daemon to stop cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the daemon to stop")
+	}
+}
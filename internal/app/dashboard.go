@@ -0,0 +1,407 @@
+package app
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"time"
+)
+
+// The dashboard of the scheduler, along with its JSON API. It shows the
+// programs of the thermostats, the programs a run would give them, and the
+// upcoming peak events, and lets runs be started and events be skipped:
+//
+//	GET  /                    The dashboard.
+//	GET  /api/status          The programs, the changes a run would make, and the events.
+//	GET  /api/plan            The programs a run would give, without talking to the thermostats.
+//	POST /api/run             Update the thermostat programs.
+//	POST /api/events/skip     Leave the event out of the programs, given as {"event": "<id>"}.
+//	POST /api/events/unskip   Plan for the event again.
+//	GET  /metrics             The metrics, in the Prometheus format.
+type Dashboard struct {
+	cfg    config.Config
+	logger *slog.Logger
+	dryRun bool
+	mux    *http.ServeMux
+
+	// Held during a run, so that only one runs at a time.
+	running sync.Mutex
+}
+
+// Returns the dashboard for |cfg|, whose runs only show their changes when
+// |dryRun|.
+func NewDashboard(cfg config.Config, logger *slog.Logger, dryRun bool) *Dashboard {
+	d := &Dashboard{cfg: cfg, logger: logger, dryRun: dryRun, mux: http.NewServeMux()}
+	restoreLastSuccess(logger)
+	d.mux.HandleFunc("/", d.servePage)
+	d.mux.HandleFunc("/api/status", d.serveStatus)
+	d.mux.HandleFunc("/api/plan", d.servePlan)
+	d.mux.HandleFunc("/api/run", d.serveRun)
+	d.mux.HandleFunc("/api/events/skip", d.serveSkip)
+	d.mux.HandleFunc("/api/events/unskip", d.serveSkip)
+	d.mux.Handle("/metrics", Metrics)
+	return d
+}
+
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+// What the dashboard shows, as returned by /api/status.
+type dashboardStatus struct {
+	Units       config.Units       `json:"units"`
+	DryRun      bool               `json:"dry_run"`
+	Thermostats []thermostatStatus `json:"thermostats"`
+	Events      []eventStatus      `json:"events"`
+}
+
+type thermostatStatus struct {
+	Name    string                `json:"name"`
+	Device  string                `json:"device,omitempty"`  // The UUID, once the thermostat was talked to.
+	Current *config.WeeklyProgram `json:"current,omitempty"` // Once the thermostat was talked to.
+	Planned config.WeeklyProgram  `json:"planned"`
+	Changes []periodChange        `json:"changes"`
+}
+
+// A period whose program a run would change.
+type periodChange struct {
+	Day     string          `json:"day"`
+	Period  string          `json:"period"`
+	Current config.DayEvent `json:"current"`
+	Planned config.DayEvent `json:"planned"`
+}
+
+type eventStatus struct {
+	ID      string    `json:"id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Offer   string    `json:"offer,omitempty"`
+	Skipped bool      `json:"skipped"`
+	Forced  bool      `json:"forced"`
+	Text    string    `json:"-"`
+}
+
+// Returns what a run would give the thermostats for the upcoming peak events,
+// along with what they have when |withDevices|.
+func (d *Dashboard) status(ctx context.Context, withDevices bool) (dashboardStatus, error) {
+	status := dashboardStatus{Units: d.cfg.Units, DryRun: d.dryRun}
+	peakEvents, err := fetchEvents(ctx, d.cfg, d.logger)
+	if err != nil {
+		return status, fmt.Errorf("failed to get peak events: %w", err)
+	}
+	now := time.Now()
+	for _, e := range upcomingEvents(peakEvents, now) {
+		status.Events = append(status.Events, eventStatus{e.ID(), e.Start, e.End, e.Offer, e.Skipped, e.Forced, formatEvent(e)})
+	}
+
+	var devices []api.Device
+	if withDevices {
+		if _, devices, err = connect(ctx, d.cfg, d.logger); err != nil {
+			return status, err
+		}
+	}
+	for _, t := range d.cfg.Thermostats {
+		tcfg := d.cfg.ForThermostat(t)
+		tlog := d.logger.With("thermostat", t.String())
+		stateData, err := planThermostat(tcfg, now, peakEvents, tlog, false)
+		if err != nil {
+			return status, fmt.Errorf("failed to plan %v: %w", t, err)
+		}
+		ts := thermostatStatus{Name: t.String(), Planned: config.ToWeeklyProgram(stateData, tcfg.DeviceUnits, d.cfg.Units)}
+		if withDevices {
+			device, err := findDevice(devices, t, tlog)
+			if err != nil {
+				return status, err
+			}
+			current := config.ToWeeklyProgram(device.StateData, tcfg.DeviceUnits, d.cfg.Units)
+			ts.Device, ts.Current, ts.Changes = device.UUID, &current, changedPeriods(current, ts.Planned)
+		}
+		status.Thermostats = append(status.Thermostats, ts)
+	}
+	return status, nil
+}
+
+// Returns the periods that differ from |current| to |planned|.
+func changedPeriods(current, planned config.WeeklyProgram) []periodChange {
+	changes := []periodChange{}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		currentPeriods := current.DailyProgramOn(day).Periods()
+		for i, p := range planned.DailyProgramOn(day).Periods() {
+			if p.Event != currentPeriods[i].Event {
+				changes = append(changes, periodChange{strings.ToLower(day.String()), p.Name, currentPeriods[i].Event, p.Event})
+			}
+		}
+	}
+	return changes
+}
+
+func (d *Dashboard) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status, err := d.status(r.Context(), true)
+	if err != nil {
+		d.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Dashboard) servePlan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status, err := d.status(r.Context(), false)
+	if err != nil {
+		d.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Dashboard) serveRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !d.allowWrite(w, r) {
+		return
+	}
+	if !d.running.TryLock() {
+		d.writeError(w, http.StatusConflict, errors.New("a run is already in progress"))
+		return
+	}
+	defer d.running.Unlock()
+
+	if err := RunWithConfig(r.Context(), d.cfg, d.logger, d.dryRun); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error(), "exit_code": ExitCode(err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dry_run": d.dryRun})
+}
+
+// Serves both /api/events/skip and /api/events/unskip.
+func (d *Dashboard) serveSkip(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !d.allowWrite(w, r) {
+		return
+	}
+	var req struct {
+		Event string `json:"event"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Event == "" {
+		d.writeError(w, http.StatusBadRequest, errors.New(`expected the event as {"event": "<id>"}`))
+		return
+	}
+	event, err := setSkipped(r.Context(), d.cfg, req.Event, !strings.HasSuffix(r.URL.Path, "/unskip"), d.logger)
+	var notFound *events.EventNotFoundError
+	if errors.As(err, &notFound) {
+		d.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		d.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, eventStatus{event.ID(), event.Start, event.End, event.Offer, event.Skipped, event.Forced, ""})
+}
+
+// Returns whether |r| uses |method|, replying that it's not allowed if not.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": r.Method + " is not allowed, use " + method})
+	return false
+}
+
+// Returns whether |r| may change the thermostats or the events, replying that
+// it's forbidden if not. Without a login, anything that can reach the
+// dashboard can change them, so at least requests from other sites are
+// refused: a web page can't send JSON to another site without its consent, and
+// browsers tell which site a request comes from.
+func (d *Dashboard) allowWrite(w http.ResponseWriter, r *http.Request) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		d.writeError(w, http.StatusUnsupportedMediaType, errors.New("expected a JSON request, with Content-Type: application/json"))
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		d.writeError(w, http.StatusForbidden, fmt.Errorf("refusing a request from another site (%v)", site))
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			d.writeError(w, http.StatusForbidden, fmt.Errorf("refusing a request from another site (%v)", origin))
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Dashboard) writeError(w http.ResponseWriter, status int, err error) {
+	d.logger.Warn("Dashboard request failed", "status", status, "err", err)
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// What the dashboard page shows.
+type dashboardPage struct {
+	Status    dashboardStatus
+	Timelines []thermostatTimeline
+	Hours     []hourTick
+	Error     string
+}
+
+// An hour marked above the timelines.
+type hourTick struct {
+	Hour int
+	Left float64
+}
+
+// The programs of a thermostat, day by day, drawn along the 24 hours.
+type thermostatTimeline struct {
+	Name, Device string
+	Days         []dayTimeline
+}
+
+type dayTimeline struct {
+	Name             string
+	Current, Planned []timelineSegment
+	Changed          bool
+}
+
+// A period of a day, positioned in percents of the day.
+type timelineSegment struct {
+	Left, Width float64
+	Hue         float64 // From blue for the coolest heat setpoint to red for the warmest.
+	Label       string
+	Title       string
+	Changed     bool
+}
+
+func (d *Dashboard) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	page := dashboardPage{}
+	for h := 0; h < 24; h += 3 {
+		page.Hours = append(page.Hours, hourTick{h, 100 * float64(h) / 24})
+	}
+	status := http.StatusOK
+	var err error
+	if page.Status, err = d.status(r.Context(), true); err != nil {
+		d.logger.Warn("Dashboard request failed", "err", err)
+		page.Error, status = err.Error(), http.StatusBadGateway
+	}
+	for _, ts := range page.Status.Thermostats {
+		page.Timelines = append(page.Timelines, timeline(ts, d.cfg.Units))
+	}
+
+	var b strings.Builder
+	if err := dashboardTemplate.Execute(&b, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, b.String())
+}
+
+// Returns the current and planned programs of |ts| as a timeline, with the
+// periods that a run would change marked.
+func timeline(ts thermostatStatus, units config.Units) thermostatTimeline {
+	current := ts.Planned
+	if ts.Current != nil {
+		current = *ts.Current
+	}
+
+	// The hues span the heat setpoints of both programs.
+	lo, hi := current.Sunday.Morning.Heat, current.Sunday.Morning.Heat
+	for _, wp := range []config.WeeklyProgram{current, ts.Planned} {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			for _, p := range wp.DailyProgramOn(day).Periods() {
+				lo, hi = min(lo, p.Event.Heat), max(hi, p.Event.Heat)
+			}
+		}
+	}
+	hue := func(heat float64) float64 {
+		if hi == lo {
+			return 30
+		}
+		return 220 * (hi - heat) / (hi - lo)
+	}
+
+	tl := thermostatTimeline{Name: ts.Name, Device: ts.Device}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		currentSegments := daySegments(current, day, units, hue)
+		plannedSegments := daySegments(ts.Planned, day, units, hue)
+		changed := false
+		for i := range plannedSegments {
+			if i >= len(currentSegments) || plannedSegments[i].Title != currentSegments[i].Title {
+				plannedSegments[i].Changed, changed = true, true
+			}
+		}
+		if len(plannedSegments) != len(currentSegments) {
+			changed = true
+		}
+		tl.Days = append(tl.Days, dayTimeline{day.String(), currentSegments, plannedSegments, changed})
+	}
+	return tl
+}
+
+// Returns the periods of |wp| on |day| along the day, starting with the
+// previous day's night, which runs until the first period.
+func daySegments(wp config.WeeklyProgram, day time.Weekday, units config.Units, hue func(float64) float64) []timelineSegment {
+	previous := wp.DailyProgramBefore(day).Night
+	periods := append([]config.Period{{Name: "night", Event: config.DayEvent{Heat: previous.Heat, Cool: previous.Cool}}},
+		wp.DailyProgramOn(day).Periods()...)
+
+	var segments []timelineSegment
+	for i, p := range periods {
+		end := 24 * time.Hour
+		if i+1 < len(periods) {
+			end = periods[i+1].Event.Time
+		}
+		if end <= p.Event.Time {
+			continue
+		}
+		segments = append(segments, timelineSegment{
+			Left:  100 * p.Event.Time.Hours() / 24,
+			Width: 100 * (end - p.Event.Time).Hours() / 24,
+			Hue:   hue(p.Event.Heat),
+			Label: fmt.Sprintf("%v%v", p.Event.Heat, units.Symbol()),
+			Title: fmt.Sprintf("%v, %v to %v: heat %v%v, cool %v%v", p.Name, clock(p.Event.Time), clock(end),
+				p.Event.Heat, units.Symbol(), p.Event.Cool, units.Symbol()),
+		})
+	}
+	return segments
+}
+
+// Returns |d| after midnight as a time of day, e.g., "07:30".
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
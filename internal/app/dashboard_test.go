@@ -0,0 +1,148 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/fake"
+)
+
+func TestDashboard(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	server := httptest.NewServer(NewDashboard(cfg, slog.Default(), false))
+	t.Cleanup(server.Close)
+
+	request := func(method, path, body string, wantStatus int) string {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%v %v: want status %v, got %v: %s", method, path, wantStatus, resp.StatusCode, data)
+		}
+		return string(data)
+	}
+	status := func(path string) dashboardStatus {
+		t.Helper()
+		var s dashboardStatus
+		if err := json.Unmarshal([]byte(request("GET", path, "", http.StatusOK)), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// The status has tomorrow's event, and the changes it makes to the
+	// program.
+	s := status("/api/status")
+	if len(s.Events) != 1 || s.Events[0].Skipped {
+		t.Fatalf("expected tomorrow's event, got %+v", s.Events)
+	}
+	if len(s.Thermostats) != 1 || s.Thermostats[0].Device != "abc" || len(s.Thermostats[0].Changes) == 0 {
+		t.Fatalf("expected changes to the thermostat, got %+v", s.Thermostats)
+	}
+	page := request("GET", "/", "", http.StatusOK)
+	for _, want := range []string{s.Events[0].ID, "segment changed", "hsl("} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the page to contain %q, got\n%v", want, page)
+		}
+	}
+
+	// A skipped event is left out of the plan, until it's planned for again.
+	event := `{"event": "` + s.Events[0].ID + `"}`
+	request("POST", "/api/events/skip", event, http.StatusOK)
+	if s := status("/api/status"); !s.Events[0].Skipped || len(s.Thermostats[0].Changes) != 0 {
+		t.Errorf("expected the skipped event to leave the program alone, got %+v", s)
+	}
+	request("POST", "/api/events/unskip", event, http.StatusOK)
+	if s := status("/api/plan"); s.Events[0].Skipped || s.Thermostats[0].Current != nil {
+		t.Errorf("expected a plan for the event, without the current program, got %+v", s)
+	}
+	request("POST", "/api/events/skip", `{"event": "2000-01-01T06:00"}`, http.StatusNotFound)
+	request("POST", "/api/events/skip", `{}`, http.StatusBadRequest)
+
+	// A run updates the thermostat.
+	request("GET", "/api/run", "", http.StatusMethodNotAllowed)
+	request("POST", "/api/run", "{}", http.StatusOK)
+	if d, _ := bluelink.Device("abc"); d.StateData == normal {
+		t.Errorf("expected the run to change the program")
+	}
+	if s := status("/api/status"); len(s.Thermostats[0].Changes) != 0 {
+		t.Errorf("expected no changes left, got %+v", s.Thermostats[0].Changes)
+	}
+	request("GET", "/nothing", "", http.StatusNotFound)
+}
+
+func TestDashboardRefusesOtherSites(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	server := httptest.NewServer(NewDashboard(cfg, slog.Default(), false))
+	t.Cleanup(server.Close)
+
+	// What a web page on another site can send without the dashboard's
+	// consent, and what browsers tell of requests from another site.
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"form", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"text", map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"no content type", nil, http.StatusUnsupportedMediaType},
+		{"other origin", map[string]string{"Content-Type": "application/json", "Origin": "https://example.com"}, http.StatusForbidden},
+		{"cross-site", map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", server.URL+"/api/run", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("want status %v, got %v", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the thermostat to be left alone")
+	}
+
+	// The dashboard's own page is allowed.
+	req, _ := http.NewRequest("POST", server.URL+"/api/run", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Origin", server.URL)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the dashboard's own request to run, got status %v", resp.StatusCode)
+	}
+}
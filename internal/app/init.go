@@ -0,0 +1,279 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Generates a config from the program the thermostat already has. Asks on
+// |in| for the BlueLink credentials, the thermostat when the account has
+// several, the peak program and the peak events URL, then writes the config
+// to |path|, which must not exist yet. When |in| is a terminal, the password
+// isn't echoed. |blueLinkURL| is the BlueLink API to
+// use, the official one when empty.
+func InitContext(ctx context.Context, in io.Reader, out io.Writer, path, blueLinkURL string, logger *slog.Logger) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%v already exists, remove it or pick another location with -config", path)
+	}
+	p := &prompter{in: bufio.NewScanner(in), out: out}
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		p.terminal = f
+	}
+
+	cfg := config.Config{BlueLinkUrl: blueLinkURL}
+	var err error
+	if cfg.Username, err = p.ask("BlueLink username", "", required); err != nil {
+		return err
+	}
+	if cfg.Password, err = p.askSecret("BlueLink password"); err != nil {
+		return err
+	}
+	_, devices, err := connect(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	device := devices[0]
+	if len(devices) > 1 {
+		fmt.Fprintln(out, "The account has several thermostats:")
+		for i, d := range devices {
+			fmt.Fprintf(out, "  %v. %v (%v)\n", i+1, d.Name, d.UUID)
+		}
+		answer, err := p.ask("Thermostat to program", "1", func(s string) error {
+			if i, err := strconv.Atoi(s); err != nil || i < 1 || i > len(devices) {
+				return fmt.Errorf("expected a number between 1 and %v", len(devices))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		i, _ := strconv.Atoi(answer)
+		device = devices[i-1]
+	}
+
+	units, err := p.ask("Is the thermostat set to celsius or fahrenheit?", string(config.Celsius), func(s string) error {
+		if s != string(config.Celsius) && s != string(config.Fahrenheit) {
+			return errors.New("expected celsius or fahrenheit")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cfg.Units = config.Units(units)
+	cfg.DeviceUnits = cfg.Units
+	cfg.NormalProgram = config.ToWeeklyProgram(device.StateData, cfg.DeviceUnits, cfg.Units)
+
+	fmt.Fprintln(out, "During peak events, the thermostat pre-heats, then sets back relative to its normal program.")
+	duration, err := p.ask("How long to pre-heat before a peak event", "1h", func(s string) error {
+		_, err := time.ParseDuration(s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cfg.PeakProgram.PreHeatDuration, _ = time.ParseDuration(duration)
+	if cfg.PeakProgram.PreHeatTempOffset, err = p.askFloat("Temperature offset while pre-heating",
+		offset(1, cfg.Units)); err != nil {
+		return err
+	}
+	if cfg.PeakProgram.PeakTempOffset, err = p.askFloat("Temperature offset during peak events",
+		offset(-2, cfg.Units)); err != nil {
+		return err
+	}
+	if cfg.PeakEventsUrl, err = p.ask("Peak events URL", events.DefaultURL, required); err != nil {
+		return err
+	}
+
+	// Name the thermostat when there are others on the account, so that only
+	// this one is programmed.
+	text := configYAML(cfg, device, len(devices) > 1)
+	if _, err := config.ReadConfig(strings.NewReader(text)); err != nil {
+		return fmt.Errorf("the generated config is invalid: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create the config directory: %w", err)
+	}
+	// The config holds the password.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	fmt.Fprintln(out, "Wrote", path)
+	return nil
+}
+
+// Asks questions on a terminal, one answer per line.
+type prompter struct {
+	in  *bufio.Scanner
+	out io.Writer
+
+	// The terminal that |in| reads from, if any.
+	terminal *os.File
+}
+
+// Asks |question| until the answer passes |check|, and returns it. An empty
+// answer picks |def|.
+func (p *prompter) ask(question, def string, check func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%v [%v]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%v: ", question)
+		}
+		if !p.in.Scan() {
+			if err := p.in.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		answer := strings.TrimSpace(p.in.Text())
+		if answer == "" {
+			answer = def
+		}
+		err := check(answer)
+		if err == nil {
+			return answer, nil
+		}
+		fmt.Fprintln(p.out, err)
+	}
+}
+
+// Like ask, but for a required answer that isn't echoed when reading from a
+// terminal, e.g., a password.
+func (p *prompter) askSecret(question string) (string, error) {
+	if p.terminal == nil {
+		return p.ask(question, "", required)
+	}
+	for {
+		fmt.Fprintf(p.out, "%v: ", question)
+		secret, err := term.ReadPassword(int(p.terminal.Fd()))
+		// The newline wasn't echoed either.
+		fmt.Fprintln(p.out)
+		if err != nil {
+			return "", err
+		}
+		answer := strings.TrimSpace(string(secret))
+		err = required(answer)
+		if err == nil {
+			return answer, nil
+		}
+		fmt.Fprintln(p.out, err)
+	}
+}
+
+// Like ask, but for a number of degrees.
+func (p *prompter) askFloat(question string, def float64) (float64, error) {
+	answer, err := p.ask(question, strconv.FormatFloat(def, 'f', -1, 64), func(s string) error {
+		_, err := strconv.ParseFloat(s, 64)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(answer, 64)
+}
+
+// Returns an offset of |degrees| Celsius in |units|, rounded to what the
+// thermostat supports.
+func offset(degrees float64, units config.Units) float64 {
+	return units.Round(config.Celsius.Convert(degrees, units) - config.Celsius.Convert(0, units))
+}
+
+func required(s string) error {
+	if s == "" {
+		return errors.New("an answer is required")
+	}
+	return nil
+}
+
+// Returns the YAML of |cfg| for |device|, with the days that have the same
+// program as an earlier one referring to it with an anchor. When |named|, the
+// program is declared under |device|'s UUID.
+func configYAML(cfg config.Config, device api.Device, named bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "username: %v\n", quote(cfg.Username))
+	fmt.Fprintf(&b, "password: %v\n", quote(cfg.Password))
+	fmt.Fprintf(&b, "peak_events_url: %v\n", quote(cfg.PeakEventsUrl))
+	if cfg.BlueLinkUrl != "" {
+		fmt.Fprintf(&b, "bluelink_url: %v\n", quote(cfg.BlueLinkUrl))
+	}
+	if cfg.Units != config.Celsius {
+		fmt.Fprintf(&b, "units: %v\n", cfg.Units)
+		fmt.Fprintf(&b, "device_units: %v\n", cfg.DeviceUnits)
+	}
+	b.WriteString("\n")
+
+	indent := ""
+	if named {
+		b.WriteString("thermostats:\n")
+		fmt.Fprintf(&b, "  - uuid: %v", quote(device.UUID))
+		if device.Name != "" {
+			fmt.Fprintf(&b, " # %v", device.Name)
+		}
+		b.WriteString("\n")
+		indent = "    "
+	}
+
+	wp := cfg.NormalProgram
+	repeats := map[config.DailyProgram]int{}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		repeats[*wp.DailyProgramOn(d)]++
+	}
+	anchors := map[config.DailyProgram]string{}
+	fmt.Fprintf(&b, "%vnormal_program:\n", indent)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		dp := *wp.DailyProgramOn(d)
+		if anchor, ok := anchors[dp]; ok {
+			fmt.Fprintf(&b, "%v  %v: *%v\n", indent, name, anchor)
+			continue
+		}
+		fmt.Fprintf(&b, "%v  %v:", indent, name)
+		if repeats[dp] > 1 {
+			anchors[dp] = name
+			fmt.Fprintf(&b, " &%v", name)
+		}
+		b.WriteString("\n")
+		for _, p := range dp.Periods() {
+			fmt.Fprintf(&b, "%v    %-8v { time: %v, heat: %v, cool: %v }\n", indent, p.Name+":",
+				config.FormatDuration(p.Event.Time), p.Event.Heat, p.Event.Cool)
+		}
+	}
+
+	pp := cfg.PeakProgram
+	fmt.Fprintf(&b, "\n%vpeak_program:\n", indent)
+	fmt.Fprintf(&b, "%v  pre_heat_duration: %v\n", indent, config.FormatDuration(pp.PreHeatDuration))
+	fmt.Fprintf(&b, "%v  pre_heat_temp_offset: %v\n", indent, pp.PreHeatTempOffset)
+	fmt.Fprintf(&b, "%v  peak_temp_offset: %v\n", indent, pp.PeakTempOffset)
+	return b.String()
+}
+
+// Returns |s| as a double-quoted YAML string.
+func quote(s string) string {
+	q, _ := json.Marshal(s)
+	return string(q)
+}
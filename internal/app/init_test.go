@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/fake"
+	"time"
+)
+
+func TestInitContext(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, "[]")
+	weekend := cfg.NormalProgram
+	weekend.Saturday.Morning = config.DayEvent{Time: 8*time.Hour + 30*time.Minute, Heat: 21.5, Cool: 24}
+	weekend.Sunday = weekend.Saturday
+	stateData, _, err := weekend.ToStateData(cfg.Units, cfg.DeviceUnits, cfg.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bluelink.AddDevice(api.Device{UUID: "abc", Name: "Home", StateData: stateData})
+	path := filepath.Join(t.TempDir(), "thermostat-scheduler", "config.yaml")
+
+	// Keeps the defaults, after a wrong answer.
+	answers := "user\npassword\nkelvin\n\n\n\n\n\n"
+	var out strings.Builder
+	if err := InitContext(context.Background(), strings.NewReader(answers), &out, path, cfg.BlueLinkUrl, slog.Default()); err != nil {
+		t.Fatalf("%v\n%v", err, out.String())
+	}
+	if !strings.Contains(out.String(), "expected celsius or fahrenheit") {
+		t.Errorf("expected the wrong units to be asked again, got\n%v", out.String())
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"sunday: &sunday", "saturday: *sunday", "monday: &monday", "friday: *monday"} {
+		if !strings.Contains(string(text), want) {
+			t.Errorf("expected %q in\n%s", want, text)
+		}
+	}
+	generated, err := config.ReadConfig(strings.NewReader(string(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.NormalProgram != weekend {
+		t.Errorf("want\n%v, got\n%v", weekend, generated.NormalProgram)
+	}
+	pp := generated.PeakProgram
+	if pp.PreHeatDuration != time.Hour || pp.PreHeatTempOffset != 1 || pp.PeakTempOffset != -2 {
+		t.Errorf("expected the default peak program, got %+v", pp)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected the config to be private, got %v", info.Mode())
+	}
+
+	// An existing config isn't overwritten.
+	if err := InitContext(context.Background(), strings.NewReader(answers), &out, path, cfg.BlueLinkUrl, slog.Default()); err == nil {
+		t.Errorf("expected the existing config to be kept")
+	}
+
+	// With several thermostats, the chosen one is declared by its UUID.
+	fahrenheit, _, err := weekend.ToStateData(cfg.Units, config.Fahrenheit, cfg.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bluelink.AddDevice(api.Device{UUID: "def", Name: "Cottage", StateData: fahrenheit})
+	path = filepath.Join(t.TempDir(), "config.yaml")
+	answers = "user\npassword\n2\nfahrenheit\n2h\n2\n-4\nhttps://example.com/events.json\n"
+	if err := InitContext(context.Background(), strings.NewReader(answers), &out, path, cfg.BlueLinkUrl, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	text, _ = os.ReadFile(path)
+	generated, err = config.ReadConfig(strings.NewReader(string(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated.Thermostats) != 1 || generated.Thermostats[0].UUID != "def" {
+		t.Errorf("expected the second thermostat, got\n%s", text)
+	}
+	if generated.Units != config.Fahrenheit || generated.PeakEventsUrl != "https://example.com/events.json" {
+		t.Errorf("expected the answers in the config, got\n%s", text)
+	}
+}
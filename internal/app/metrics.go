@@ -0,0 +1,128 @@
+package app
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"thermostat-scheduler/internal/metrics"
+	"time"
+)
+
+// The metrics of the scheduler, to serve or to write after every run.
+var Metrics = metrics.NewRegistry()
+
+var (
+	lastSuccess = Metrics.NewGauge("thermostat_scheduler_last_success_timestamp_seconds",
+		"When all the thermostats were last programmed successfully.")
+	lastEventFetch = Metrics.NewGauge("thermostat_scheduler_last_event_fetch_timestamp_seconds",
+		"When the peak events were last fetched.")
+	upcomingEventCount = Metrics.NewGauge("thermostat_scheduler_upcoming_events",
+		"The number of peak events that haven't ended yet.")
+	nextEventStart = Metrics.NewGauge("thermostat_scheduler_next_event_start_timestamp_seconds",
+		"When the next peak event that isn't skipped starts.")
+	programChanges = Metrics.NewCounter("thermostat_scheduler_program_changes_total",
+		"The number of new programs written to the thermostats.", "thermostat")
+	apiErrors = Metrics.NewCounter("thermostat_scheduler_api_errors_total",
+		"The number of failed requests to the BlueLink API.", "endpoint")
+	plannedSetpoint = Metrics.NewGauge("thermostat_scheduler_planned_setpoint_degrees",
+		"The temperature planned for each period, in the units of the config.", "thermostat", "day", "period", "mode")
+	plannedPeriodStart = Metrics.NewGauge("thermostat_scheduler_planned_period_start_seconds",
+		"When each planned period starts, in seconds after midnight.", "thermostat", "day", "period")
+)
+
+// Records what's coming among |peakEvents| at |now|, and that they were just
+// fetched if |fetched|.
+func recordEvents(peakEvents []events.PeakEvent, fetched bool, now time.Time) {
+	if fetched {
+		lastEventFetch.Set(seconds(now))
+	}
+	upcoming := upcomingEvents(peakEvents, now)
+	upcomingEventCount.Set(float64(len(upcoming)))
+	nextEventStart.Reset()
+	for _, e := range upcoming {
+		if e.Start.After(now) && !e.Skipped {
+			nextEventStart.Set(seconds(e.Start))
+			break
+		}
+	}
+}
+
+// Records the periods of |wp|, the program planned for |t|.
+func recordPlan(t config.Thermostat, wp config.WeeklyProgram) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		day := strings.ToLower(d.String())
+		for _, p := range wp.DailyProgramOn(d).Periods() {
+			plannedSetpoint.Set(p.Event.Heat, t.String(), day, p.Name, "heat")
+			plannedSetpoint.Set(p.Event.Cool, t.String(), day, p.Name, "cool")
+			plannedPeriodStart.Set(p.Event.Time.Seconds(), t.String(), day, p.Name)
+		}
+	}
+}
+
+// Records that all the thermostats were programmed at |now|, and if |keep|,
+// keeps it in the user's cache directory, so that a later run that fails still
+// reports it.
+func recordSuccess(now time.Time, keep bool, logger *slog.Logger) {
+	lastSuccess.Set(seconds(now))
+	if !keep {
+		return
+	}
+	path, err := lastSuccessPath()
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = os.WriteFile(path, []byte(strconv.FormatFloat(seconds(now), 'f', -1, 64)+"\n"), 0644)
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to keep the time of the last success", "err", err)
+	}
+}
+
+// Sets the time of the last success to the one kept by a previous run, if
+// any, since every run starts without metrics.
+func restoreLastSuccess(logger *slog.Logger) {
+	path, err := lastSuccessPath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var last float64
+	if err == nil {
+		last, err = strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	}
+	if err != nil {
+		logger.Warn("Failed to read the time of the last success", "path", path, "err", err)
+		return
+	}
+	lastSuccess.Set(last)
+}
+
+func lastSuccessPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "thermostat-scheduler", "last_success"), nil
+}
+
+// Writes the metrics to the textfile of |cfg|, if any.
+func writeMetrics(cfg config.Config, logger *slog.Logger) {
+	if cfg.Metrics.Textfile == "" {
+		return
+	}
+	if err := Metrics.WriteFile(cfg.Metrics.Textfile); err != nil {
+		logger.Warn("Failed to write the metrics", "path", cfg.Metrics.Textfile, "err", err)
+	}
+}
+
+// Returns |t| as seconds since the epoch.
+func seconds(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
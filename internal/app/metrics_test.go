@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/fake"
+)
+
+func TestRunWithConfigMetrics(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	cfg.Metrics.Textfile = filepath.Join(t.TempDir(), "thermostat-scheduler.prom")
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normalStateData(t, cfg)})
+	bluelink.Fail(fake.Failure{Endpoint: fake.DevicesEndpoint, Status: http.StatusServiceUnavailable}, 1)
+
+	if err := RunWithConfig(context.Background(), cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(cfg.Metrics.Textfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"thermostat_scheduler_last_success_timestamp_seconds ",
+		"thermostat_scheduler_upcoming_events 1\n",
+		"thermostat_scheduler_next_event_start_timestamp_seconds ",
+		`thermostat_scheduler_program_changes_total{thermostat="` + cfg.Thermostats[0].String() + `"}`,
+		`thermostat_scheduler_api_errors_total{endpoint="`,
+		`thermostat_scheduler_planned_setpoint_degrees{thermostat="` + cfg.Thermostats[0].String() + `",day="monday",period="morning",mode="heat"}`,
+		`thermostat_scheduler_planned_period_start_seconds{thermostat="` + cfg.Thermostats[0].String() + `",day="monday",period="morning"}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected the metrics to contain %q, got\n%s", want, data)
+		}
+	}
+}
+
+func TestLastSuccessOutlivesTheRun(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	cfg.Metrics.Textfile = filepath.Join(t.TempDir(), "thermostat-scheduler.prom")
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normalStateData(t, cfg)})
+	ctx := context.Background()
+
+	lastSuccessLine := func() string {
+		t.Helper()
+		data, err := os.ReadFile(cfg.Metrics.Textfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "thermostat_scheduler_last_success_timestamp_seconds ") {
+				return line
+			}
+		}
+		return ""
+	}
+
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	succeeded := lastSuccessLine()
+	if succeeded == "" {
+		t.Fatal("expected the time of the success")
+	}
+
+	// A later run starts without metrics, as from cron, and fails, but still
+	// reports when the last one succeeded.
+	lastSuccess.Reset()
+	bluelink.Fail(fake.Failure{Endpoint: fake.DevicesEndpoint, Status: http.StatusBadRequest}, 10)
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if got := lastSuccessLine(); got != succeeded {
+		t.Errorf("want %q, got %q", succeeded, got)
+	}
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Writes the current program of each thermostat of |cfg|, and the upcoming
+// peak events, to |out|.
+func StatusContext(ctx context.Context, cfg config.Config, out io.Writer, logger *slog.Logger) error {
+	peakEvents, err := fetchEvents(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get peak events: %w", err)
+	}
+	_, devices, err := connect(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range cfg.Thermostats {
+		device, err := findDevice(devices, t, logger)
+		if err != nil {
+			return err
+		}
+		program := config.ToWeeklyProgram(device.StateData, t.DeviceUnits, cfg.Units)
+		writeProgram(out, fmt.Sprintf("%v (%v), program in %v:", t, device.UUID, cfg.Units.Symbol()), program)
+	}
+	writeEvents(out, upcomingEvents(peakEvents, time.Now()))
+	return nil
+}
+
+// Writes the peak events that haven't ended yet to |out|.
+func EventsContext(ctx context.Context, cfg config.Config, out io.Writer, logger *slog.Logger) error {
+	peakEvents, err := fetchEvents(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get peak events: %w", err)
+	}
+	writeEvents(out, upcomingEvents(peakEvents, time.Now()))
+	return nil
+}
+
+// Writes the program that a run would give each thermostat of |cfg| to |out|,
+// without talking to the thermostats.
+func PlanContext(ctx context.Context, cfg config.Config, out io.Writer, logger *slog.Logger) error {
+	peakEvents, err := fetchEvents(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get peak events: %w", err)
+	}
+
+	now := time.Now()
+	for _, t := range cfg.Thermostats {
+		tcfg := cfg.ForThermostat(t)
+		stateData, err := planThermostat(tcfg, now, peakEvents, logger.With("thermostat", t.String()), true)
+		if err != nil {
+			return fmt.Errorf("failed to plan %v: %w", t, err)
+		}
+		program := config.ToWeeklyProgram(stateData, tcfg.DeviceUnits, cfg.Units)
+		writeProgram(out, fmt.Sprintf("%v, planned program in %v:", t, cfg.Units.Symbol()), program)
+	}
+	return nil
+}
+
+// Writes the changes that a run would make to each thermostat of |cfg| to
+// |out|, without making them.
+func DiffContext(ctx context.Context, cfg config.Config, out io.Writer, logger *slog.Logger) error {
+	peakEvents, err := fetchEvents(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get peak events: %w", err)
+	}
+	_, devices, err := connect(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, t := range cfg.Thermostats {
+		device, err := findDevice(devices, t, logger)
+		if err != nil {
+			return err
+		}
+		tcfg := cfg.ForThermostat(t)
+		stateData, err := planThermostat(tcfg, now, peakEvents, logger.With("thermostat", t.String()), false)
+		if err != nil {
+			return fmt.Errorf("failed to plan %v: %w", t, err)
+		}
+		if stateData == device.StateData {
+			fmt.Fprintf(out, "%v: no changes\n", t)
+			continue
+		}
+		fmt.Fprintf(out, "%v, changes in %v:\n%v", t, cfg.Units.Symbol(), programDiff(tcfg, device.StateData, stateData))
+	}
+	return nil
+}
+
+// Returns the events of |peakEvents| that haven't ended at |now|, sorted by
+// start time.
+func upcomingEvents(peakEvents []events.PeakEvent, now time.Time) []events.PeakEvent {
+	var upcoming []events.PeakEvent
+	for _, e := range peakEvents {
+		if now.Before(e.End) {
+			upcoming = append(upcoming, e)
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return upcoming[i].Start.Before(upcoming[j].Start)
+	})
+	return upcoming
+}
+
+func writeEvents(out io.Writer, upcoming []events.PeakEvent) {
+	if len(upcoming) == 0 {
+		fmt.Fprintln(out, "No upcoming peak events.")
+		return
+	}
+	fmt.Fprintln(out, "Upcoming peak events:")
+	for _, e := range upcoming {
+		fmt.Fprintf(out, "  %v\n", formatEvent(e))
+	}
+}
+
+// Returns |e| in local time, e.g., "Mon 2024-01-15 06:00 to 09:00 (CPC-D)".
+func formatEvent(e events.PeakEvent) string {
+	start, end := e.Start.Local(), e.End.Local()
+	endLayout := "15:04"
+	if start.YearDay() != end.YearDay() || start.Year() != end.Year() {
+		endLayout = "Mon 2006-01-02 15:04"
+	}
+	s := start.Format("Mon 2006-01-02 15:04") + " to " + end.Format(endLayout)
+	if e.Offer != "" {
+		s += " (" + e.Offer + ")"
+	}
+	if e.Forced {
+		s += ", forced"
+	}
+	if e.Skipped {
+		s += ", skipped"
+	}
+	return s
+}
+
+// Writes |program| to |out| as in the config, under |title|.
+func writeProgram(out io.Writer, title string, program config.WeeklyProgram) {
+	fmt.Fprintln(out, title)
+	data, err := yaml.Marshal(program)
+	if err != nil {
+		fmt.Fprintf(out, "  %v\n", err)
+		return
+	}
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n") {
+		fmt.Fprint(out, "  ", line)
+	}
+	fmt.Fprintln(out)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/fake"
+)
+
+func TestReports(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", Name: "Home", StateData: normal})
+	ctx := context.Background()
+
+	var out strings.Builder
+	if err := StatusContext(ctx, cfg, &out, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"(abc), program in C:", "morning: {time: 7h, heat: 21, cool: 24}", "Upcoming peak events:", "(CPC-D)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the status, got\n%v", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := EventsContext(ctx, cfg, &out, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[1], "06:00 to 09:00 (CPC-D)") {
+		t.Errorf("expected a single event, got\n%v", out.String())
+	}
+
+	// Plan and diff show the peak setback, and leave the thermostat alone.
+	out.Reset()
+	if err := PlanContext(ctx, cfg, &out, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "heat: 18") {
+		t.Errorf("expected the peak setback in the plan, got\n%v", out.String())
+	}
+	out.Reset()
+	if err := DiffContext(ctx, cfg, &out, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "changes in C:") || !strings.Contains(out.String(), "Heat: 18") {
+		t.Errorf("expected the peak setback in the diff, got\n%v", out.String())
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the program to be left alone, got %v", d.StateData)
+	}
+
+	// Once programmed, there's nothing left to change.
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := DiffContext(ctx, cfg, &out, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "thermostat: no changes\n" {
+		t.Errorf("expected no changes, got\n%v", out.String())
+	}
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"thermostat-scheduler/internal/config"
+	"thermostat-scheduler/internal/events"
+	"time"
+)
+
+// Leaves the peak event whose ID is |id|, its start, e.g.,
+// "2024-01-15T06:00", out of the programs from the next run on.
+func SkipContext(ctx context.Context, cfg config.Config, id string, logger *slog.Logger) (events.PeakEvent, error) {
+	return setSkipped(ctx, cfg, id, true, logger)
+}
+
+// Plans for the peak event whose ID is |id| again, from the next run on.
+func UnskipContext(ctx context.Context, cfg config.Config, id string, logger *slog.Logger) (events.PeakEvent, error) {
+	return setSkipped(ctx, cfg, id, false, logger)
+}
+
+func setSkipped(ctx context.Context, cfg config.Config, id string, skipped bool, logger *slog.Logger) (events.PeakEvent, error) {
+	start, err := time.ParseInLocation("2006-01-02T15:04", id, time.Local)
+	if err != nil {
+		return events.PeakEvent{}, fmt.Errorf("invalid event %q, expected its start, e.g., 2024-01-15T06:00: %w", id, err)
+	}
+	event := events.PeakEvent{Start: start}
+
+	// Check that the event exists, but without depending on the events being
+	// fetched, e.g., to skip an event when Hydro-Quebec's are down.
+	peakEvents, fetchErr := events.GetPeakEventsContext(ctx, cfg.PeakEventsUrl, cfg.Retry, !cfg.FakeThermostat, logger)
+	if found, err := events.FindEvent(peakEvents, id); err == nil {
+		event = found
+	} else if fetchErr == nil {
+		return event, err
+	} else {
+		logger.Warn("Skipping the event without checking that it exists", "err", fetchErr)
+	}
+
+	skipList, err := events.NewSkipList()
+	if err != nil {
+		return event, fmt.Errorf("failed to create skip list: %w", err)
+	}
+	if skipped {
+		err = skipList.Skip(event.Start)
+	} else {
+		err = skipList.Unskip(event.Start)
+	}
+	if err != nil {
+		return event, fmt.Errorf("failed to update the skipped events: %w", err)
+	}
+	event.Skipped = skipped
+	logger.Info("Updated the skipped events", "event", event)
+	return event, nil
+}
+
+// The longest a forced event can last, like the longest peak events.
+const maxForcedDuration = 12 * time.Hour
+
+// Adds a peak event from |start| that lasts |duration| to the announced ones,
+// from the next run on, e.g., to try the whole flow, or to respond to a signal
+// other than Hydro-Quebec's. The event can be skipped like the others.
+func ForceEvent(start time.Time, duration time.Duration, logger *slog.Logger) (events.PeakEvent, error) {
+	if duration <= 0 || duration > maxForcedDuration {
+		return events.PeakEvent{}, fmt.Errorf("the event should last between 0s and %v, got %v", maxForcedDuration, duration)
+	}
+	if end := start.Add(duration); !end.After(time.Now()) {
+		return events.PeakEvent{}, fmt.Errorf("the event would already be over at %v", end.Format("2006-01-02 15:04"))
+	}
+
+	forcedEvents, err := events.NewForcedEvents()
+	if err != nil {
+		return events.PeakEvent{}, fmt.Errorf("failed to create forced events: %w", err)
+	}
+	event, err := forcedEvents.Add(start, start.Add(duration))
+	if err != nil {
+		return event, fmt.Errorf("failed to add the forced event: %w", err)
+	}
+	logger.Info("Forced a peak event", "event", event)
+	return event, nil
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/events"
+	"thermostat-scheduler/internal/fake"
+	"time"
+)
+
+func TestSkip(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, tomorrowMorningEvent())
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	ctx := context.Background()
+
+	now := time.Now()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	id := tomorrow.Add(6 * time.Hour).Format("2006-01-02T15:04")
+
+	// A skipped event leaves the program alone.
+	event, err := SkipContext(ctx, cfg, id, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Skipped {
+		t.Errorf("expected the event to be skipped, got %+v", event)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the skipped event to leave the program alone, got %v", d.StateData)
+	}
+
+	// Once planned for again, it changes the program.
+	if _, err := UnskipContext(ctx, cfg, id, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData == normal {
+		t.Errorf("expected the program to change")
+	}
+
+	var notFound *events.EventNotFoundError
+	if _, err := SkipContext(ctx, cfg, "2000-01-01T06:00", slog.Default()); !errors.As(err, &notFound) {
+		t.Errorf("expected the event not to be found, got %v", err)
+	}
+}
+
+func TestForceEvent(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, "[]")
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	ctx := context.Background()
+
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day()+1, 6, 0, 0, 0, now.Location())
+	for _, duration := range []time.Duration{0, 13 * time.Hour} {
+		if _, err := ForceEvent(start, duration, slog.Default()); err == nil {
+			t.Errorf("expected an event of %v to be rejected", duration)
+		}
+	}
+	if _, err := ForceEvent(start.AddDate(0, 0, -2), time.Hour, slog.Default()); err == nil {
+		t.Errorf("expected an event that is over to be rejected")
+	}
+
+	// A forced event is programmed like the announced ones.
+	event, err := ForceEvent(start, 3*time.Hour, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	programmed, _ := bluelink.Device("abc")
+	if programmed.StateData == normal {
+		t.Errorf("expected the forced event to change the program")
+	}
+
+	// Skipping it cancels it.
+	if _, err := SkipContext(ctx, cfg, event.ID(), slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the skipped forced event to leave the program alone, got %v", d.StateData)
+	}
+}
+
+func TestSkipWhenDown(t *testing.T) {
+	bluelink := fake.NewBlueLink("user", "password")
+	cfg := testConfig(t, bluelink, "[]")
+	normal := normalStateData(t, cfg)
+	bluelink.AddDevice(api.Device{UUID: "abc", StateData: normal})
+	ctx := context.Background()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+	cfg.PeakEventsUrl = down.URL
+
+	// Without any events, the run fails.
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err == nil {
+		t.Errorf("expected the run to fail")
+	}
+
+	// A forced event is still programmed.
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day()+1, 6, 0, 0, 0, now.Location())
+	event, err := ForceEvent(start, 3*time.Hour, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData == normal {
+		t.Errorf("expected the forced event to change the program")
+	}
+
+	// Events can still be skipped, even those that can't be checked.
+	if _, err := SkipContext(ctx, cfg, event.ID(), slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SkipContext(ctx, cfg, start.AddDate(0, 0, 1).Format("2006-01-02T15:04"), slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunWithConfig(ctx, cfg, slog.Default(), false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := bluelink.Device("abc"); d.StateData != normal {
+		t.Errorf("expected the skipped forced event to leave the program alone, got %v", d.StateData)
+	}
+	if _, err := SkipContext(ctx, cfg, "tomorrow", slog.Default()); err == nil {
+		t.Errorf("expected an invalid event to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/client"
+	"time"
+)
+
+// How many times to write a program until the thermostat holds it.
+const verifyAttempts = 3
+
+// How long to wait after writing a program before reading it back, to give
+// the thermostat time to sync. Replaced in tests.
+var verifyDelay = 5 * time.Second
+
+// The thermostat doesn't hold the program that was written to it.
+type VerificationError struct {
+	UUID       string
+	Mismatched []string // The programs that differ, e.g., "PGM_03".
+	RolledBack bool     // Whether the previous program was restored.
+}
+
+func (e *VerificationError) Error() string {
+	outcome := "the previous program couldn't be restored"
+	if e.RolledBack {
+		outcome = "restored the previous program"
+	}
+	return fmt.Sprintf("device %v doesn't hold the new program for %v after %v attempts; %v",
+		e.UUID, strings.Join(e.Mismatched, ", "), verifyAttempts, outcome)
+}
+
+// Writes |data| to the device with |uuid|, then reads it back and compares
+// it, writing it again when it differs. Returns a VerificationError when the
+// device still doesn't hold |data| after verifyAttempts.
+func writeAndVerify(ctx context.Context, apiClient *client.Client, uuid string, data api.StateData, logger *slog.Logger) error {
+	for attempt := 1; ; attempt++ {
+		_, err := apiClient.SetDeviceAttributesContext(ctx, uuid, data)
+		if err != nil {
+			return fmt.Errorf("failed to update device schedule: %w", err)
+		}
+
+		select {
+		case <-time.After(verifyDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		devices, err := apiClient.DevicesContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read back device schedule: %w", err)
+		}
+		var got api.StateData
+		for _, d := range devices {
+			if d.UUID == uuid {
+				got = d.StateData
+			}
+		}
+
+		mismatched := mismatchedPrograms(data, got)
+		if len(mismatched) == 0 {
+			return nil
+		}
+		if attempt >= verifyAttempts {
+			return &VerificationError{UUID: uuid, Mismatched: mismatched}
+		}
+		logger.Warn("Device doesn't hold the new program, writing it again", "programs", strings.Join(mismatched, ", "))
+	}
+}
+
+// Returns the names of the programs that differ between |want| and |got|.
+func mismatchedPrograms(want, got api.StateData) []string {
+	var mismatched []string
+	for _, p := range []struct {
+		name      string
+		want, got string
+	}{
+		{"PGM_01", want.Program1, got.Program1},
+		{"PGM_02", want.Program2, got.Program2},
+		{"PGM_03", want.Program3, got.Program3},
+		{"PGM_04", want.Program4, got.Program4},
+		{"PGM_05", want.Program5, got.Program5},
+		{"PGM_06", want.Program6, got.Program6},
+		{"PGM_07", want.Program7, got.Program7},
+	} {
+		if p.want != p.got {
+			mismatched = append(mismatched, p.name)
+		}
+	}
+	return mismatched
+}
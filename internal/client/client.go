@@ -2,13 +2,18 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/retry"
 	"time"
 )
 
@@ -18,22 +23,52 @@ type Client struct {
 
 	httpClient   *http.Client
 	roundTripper *AuthorizingRoundTripper
+
+	// The credentials from Login, kept to login again when the session
+	// expires.
+	username string
+	password string
+	tokens   TokenStore
+
+	retryPolicy retry.Policy
+
+	// Called with every failed request.
+	observeError func(endpoint string, err error)
 }
 
+// The URL of the BlueLink API.
+const DefaultBaseURL = "https://sd2.bluelinksmartconnect.com/api/v1/braeburn/"
+
 func New() *Client {
-	baseURL, _ := url.Parse("https://sd2.bluelinksmartconnect.com/api/v1/braeburn/")
+	c, _ := NewWithBaseURL(DefaultBaseURL)
+	return c
+}
+
+// Returns a client for the BlueLink API at |baseURL|, e.g., a fake one.
+func NewWithBaseURL(baseURL string) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
 	jar, _ := cookiejar.New(nil)
 
 	rt := &AuthorizingRoundTripper{}
 	return &Client{
-		baseURL:   baseURL,
+		baseURL:   base,
 		userAgent: "Braeburn/13 CFNetwork/1406.0.4 Darwin/22.4.0",
 		httpClient: &http.Client{
 			Jar:       jar,
 			Timeout:   30 * time.Second,
 			Transport: rt,
-		}, roundTripper: rt}
+		}, roundTripper: rt}, nil
+}
 
+// Returns the URL of the API this client uses.
+func (c *Client) BaseURL() string {
+	return c.baseURL.String()
 }
 
 type AuthorizingRoundTripper struct {
@@ -42,7 +77,8 @@ type AuthorizingRoundTripper struct {
 
 func (t *AuthorizingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	if t.token != nil {
-		req.Header.Add("Authorization", *t.token)
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", *t.token)
 	}
 	resp, err := http.DefaultTransport.RoundTrip(req)
 	if err != nil {
@@ -51,27 +87,84 @@ func (t *AuthorizingRoundTripper) RoundTrip(req *http.Request) (*http.Response,
 	return resp, err
 }
 
+// Keeps the session token in |s|, to reuse it in later runs instead of
+// logging in every time.
+func (c *Client) UseTokenStore(s TokenStore) {
+	c.tokens = s
+}
+
+// Retries the requests that fail transiently and are safe to send again
+// following |p|.
+func (c *Client) UseRetryPolicy(p retry.Policy) {
+	c.retryPolicy = p
+}
+
+// Calls |f| with the endpoint and the error of every request that fails,
+// including the ones that are retried, e.g., to count them. The endpoint is
+// the last part of the path, e.g., "login" or "setstateattr".
+func (c *Client) ObserveErrors(f func(endpoint string, err error)) {
+	c.observeError = f
+}
+
+// Logs in with |username| and |password|, unless a token was saved by a
+// previous run. When the token turns out to be expired, the client logs in
+// again.
 func (c *Client) Login(username string, password string) error {
-	loginDetails := api.LoginDetails{Username: username, Password: password}
+	return c.LoginContext(context.Background(), username, password)
+}
+
+// Like Login, but stops when |ctx| is done.
+func (c *Client) LoginContext(ctx context.Context, username string, password string) error {
+	c.username, c.password = username, password
+	if c.tokens != nil {
+		if token, err := c.tokens.Load(); err == nil && token != "" {
+			c.roundTripper.token = &token
+			return nil
+		}
+	}
+	return c.login(ctx)
+}
+
+func (c *Client) login(ctx context.Context) error {
+	loginDetails := api.LoginDetails{Username: c.username, Password: c.password}
 
-	req, err := c.newRequest("POST", "rest-auth/login/", loginDetails)
+	req, err := c.newRequest(ctx, "POST", "rest-auth/login/", loginDetails)
 	if err != nil {
 		return fmt.Errorf("failed to create login HTTP request: %w", err)
 	}
 
+	// Don't send an expired token along.
+	c.roundTripper.token = nil
 	var auth api.AuthenticationKey
 	_, err = c.do(req, &auth)
+	// The API rejects bad credentials as an invalid request.
+	var rejected *ValidationError
+	if errors.As(err, &rejected) {
+		err = &UnauthorizedError{rejected.APIError}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to login: %w", err)
 	}
 
 	token := "Token " + auth.Key
 	c.roundTripper.token = &token
+	// Keeping the token only saves logging in on the next run, so carry on
+	// with it when it can't be kept.
+	if c.tokens != nil {
+		if err := c.tokens.Save(token); err != nil {
+			slog.Warn("Not keeping the session token between runs", "err", err)
+		}
+	}
 	return nil
 }
 
 func (c *Client) Devices() ([]api.Device, error) {
-	req, err := c.newRequest("GET", "devices/", nil)
+	return c.DevicesContext(context.Background())
+}
+
+// Like Devices, but stops when |ctx| is done.
+func (c *Client) DevicesContext(ctx context.Context) ([]api.Device, error) {
+	req, err := c.newRequest(ctx, "GET", "devices/", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create device list HTTP request: %w", err)
 	}
@@ -85,7 +178,12 @@ func (c *Client) Devices() ([]api.Device, error) {
 }
 
 func (c *Client) SetDeviceAttributes(deviceId string, data api.StateData) (api.Device, error) {
-	req, err := c.newRequest("POST", "manage/"+deviceId+"/setstateattr/", data)
+	return c.SetDeviceAttributesContext(context.Background(), deviceId, data)
+}
+
+// Like SetDeviceAttributes, but stops when |ctx| is done.
+func (c *Client) SetDeviceAttributesContext(ctx context.Context, deviceId string, data api.StateData) (api.Device, error) {
+	req, err := c.newRequest(ctx, "POST", "manage/"+deviceId+"/setstateattr/", data)
 
 	if err != nil {
 		return api.Device{}, fmt.Errorf("failed to create device update HTTP request: %w", err)
@@ -100,7 +198,7 @@ func (c *Client) SetDeviceAttributes(deviceId string, data api.StateData) (api.D
 	return updated, nil
 }
 
-func (c *Client) newRequest(method, path string, body any) (*http.Request, error) {
+func (c *Client) newRequest(ctx context.Context, method, path string, body any) (*http.Request, error) {
 	relative := &url.URL{Path: path}
 	url := c.baseURL.ResolveReference(relative)
 
@@ -113,7 +211,7 @@ func (c *Client) newRequest(method, path string, body any) (*http.Request, error
 		}
 	}
 
-	req, err := http.NewRequest(method, url.String(), buf)
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), buf)
 	if err != nil {
 		return nil, err
 	}
@@ -126,13 +224,99 @@ func (c *Client) newRequest(method, path string, body any) (*http.Request, error
 	return req, nil
 }
 
+// Sends |req| and decodes the response into |v|. Transient failures are
+// retried following the retry policy, when |req| is safe to send again.
 func (c *Client) do(req *http.Request, v any) (*http.Response, error) {
+	policy := retry.Policy{}
+	if isSafeToRetry(req) {
+		policy = c.retryPolicy
+	}
+
+	var resp *http.Response
+	attempt := req
+	err := policy.DoContext(req.Context(), func() error {
+		var err error
+		if attempt == nil {
+			if attempt, err = replay(req); err != nil {
+				return err
+			}
+		}
+		resp, err = c.send(attempt, v)
+		attempt = nil
+		if err != nil && c.observeError != nil {
+			c.observeError(endpoint(req), err)
+		}
+		return err
+	})
+	return resp, err
+}
+
+// Sends |req| once and decodes the response into |v|. When the session has
+// expired, logs in again and replays |req| once.
+func (c *Client) send(req *http.Request, v any) (*http.Response, error) {
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, retry.Retryable(err, 0)
+	}
+	if isUnauthorized(resp) && c.roundTripper.token != nil && c.username != "" {
+		resp.Body.Close()
+		if err := c.login(req.Context()); err != nil {
+			return nil, err
+		}
+		if req, err = replay(req); err != nil {
+			return nil, err
+		}
+		if resp, err = c.httpClient.Do(req); err != nil {
+			return nil, retry.Retryable(err, 0)
+		}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := newError(resp)
+		switch e := err.(type) {
+		case *RateLimitedError:
+			return resp, retry.Retryable(err, e.RetryAfter)
+		case *ServerError:
+			return resp, retry.Retryable(err, retry.After(resp.Header))
+		}
+		return resp, err
+	}
+
 	err = json.NewDecoder(resp.Body).Decode(v)
 	return resp, err
 }
+
+// Returns whether sending |req| more than once has the same effect as sending
+// it once, which is the case of logging in and setting a device's state.
+func isSafeToRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return strings.HasSuffix(req.URL.Path, "/rest-auth/login/") || strings.HasSuffix(req.URL.Path, "/setstateattr/")
+}
+
+// Returns the last part of the path of |req|, which names the endpoint without
+// the device it's for.
+func endpoint(req *http.Request) string {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func isUnauthorized(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+// Returns a copy of |req| that can be sent again.
+func replay(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay request: %w", err)
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
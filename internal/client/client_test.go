@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/retry"
+	"time"
+)
+
+type memoryTokenStore struct {
+	token   string
+	saveErr error
+}
+
+func (s *memoryTokenStore) Load() (string, error) {
+	return s.token, nil
+}
+
+func (s *memoryTokenStore) Save(token string) error {
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	s.token = token
+	return nil
+}
+
+func TestReloginOnExpiredToken(t *testing.T) {
+	logins := 0
+	var updated api.StateData
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest-auth/login/", func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		json.NewEncoder(w).Encode(api.AuthenticationKey{Key: "fresh"})
+	})
+	mux.HandleFunc("/manage/abc/setstateattr/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&updated)
+		json.NewEncoder(w).Encode(api.Device{UUID: "abc", StateData: updated})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c, _ := NewWithBaseURL(server.URL)
+	tokens := &memoryTokenStore{token: "Token expired"}
+	c.UseTokenStore(tokens)
+
+	// The saved token is used without logging in.
+	if err := c.Login("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if logins != 0 {
+		t.Errorf("expected the saved token to be used, got %v logins", logins)
+	}
+
+	// The expired token is replaced, and the request is replayed with its
+	// body.
+	want := api.StateData{Program1: "0700210"}
+	device, err := c.SetDeviceAttributes("abc", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logins != 1 || tokens.token != "Token fresh" {
+		t.Errorf("expected a single login and a saved token, got %v logins and %q", logins, tokens.token)
+	}
+	if updated != want || device.StateData != want {
+		t.Errorf("want %v, got %v and %v", want, updated, device.StateData)
+	}
+}
+
+func TestLoginWithoutSavingToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest-auth/login/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.AuthenticationKey{Key: "fresh"})
+	})
+	mux.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode([]api.Device{{UUID: "abc"}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// A token that can't be kept, e.g., in a read-only cache, is still
+	// used.
+	c, _ := NewWithBaseURL(server.URL)
+	c.UseTokenStore(&memoryTokenStore{saveErr: errors.New("read-only file system")})
+	if err := c.Login("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := c.Devices(); err != nil || len(devices) != 1 {
+		t.Errorf("expected the device, got %v, %v", devices, err)
+	}
+}
+
+func TestUnauthorizedAfterRelogin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest-auth/login/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.AuthenticationKey{Key: "fresh"})
+	})
+	mux.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c, _ := NewWithBaseURL(server.URL)
+	if err := c.Login("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Devices(); err == nil {
+		t.Errorf("expected an error when the device list stays forbidden")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		header string
+		body   string
+		check  func(error) bool
+	}{
+		{http.StatusUnauthorized, "", `{"detail": "Invalid token."}`, func(err error) bool {
+			var e *UnauthorizedError
+			return errors.As(err, &e) && e.Body == `{"detail": "Invalid token."}`
+		}},
+		{http.StatusTooManyRequests, "120", "", func(err error) bool {
+			var e *RateLimitedError
+			return errors.As(err, &e) && e.RetryAfter == 2*time.Minute
+		}},
+		{http.StatusBadRequest, "", `{"detail": "Device is offline."}`, func(err error) bool {
+			var e *DeviceOfflineError
+			return errors.As(err, &e)
+		}},
+		{http.StatusBadRequest, "", `{"PGM_01": ["Invalid program."]}`, func(err error) bool {
+			var e *ValidationError
+			return errors.As(err, &e) && e.StatusCode == http.StatusBadRequest
+		}},
+		{http.StatusBadGateway, "", "", func(err error) bool {
+			var e *ServerError
+			return errors.As(err, &e)
+		}},
+		{http.StatusNotFound, "", "", func(err error) bool {
+			var e *APIError
+			return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+		}},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.header != "" {
+				w.Header().Set("Retry-After", tt.header)
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		c, _ := NewWithBaseURL(server.URL)
+		_, err := c.Devices()
+		if !tt.check(err) {
+			t.Errorf("for %v %q, got unexpected error %#v", tt.status, tt.body, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var data api.StateData
+		json.NewDecoder(r.Body).Decode(&data)
+		json.NewEncoder(w).Encode(api.Device{UUID: "abc", StateData: data})
+	}))
+	defer server.Close()
+
+	c, _ := NewWithBaseURL(server.URL)
+	c.UseRetryPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	failed := map[string]int{}
+	c.ObserveErrors(func(endpoint string, err error) {
+		failed[endpoint]++
+	})
+
+	// Setting the device's state is safe to retry, and the body is sent again.
+	want := api.StateData{Program1: "0700210"}
+	device, err := c.SetDeviceAttributes("abc", want)
+	if err != nil || requests != 2 {
+		t.Fatalf("expected success on the second request, got %v requests and %v", requests, err)
+	}
+	if device.StateData != want {
+		t.Errorf("want %v, got %v", want, device.StateData)
+	}
+	if failed["setstateattr"] != 1 {
+		t.Errorf("expected the failed attempt to be observed, got %v", failed)
+	}
+
+	// Other requests that change something aren't retried.
+	requests = 0
+	req, _ := c.newRequest(context.Background(), "POST", "manage/abc/other/", nil)
+	if _, err := c.do(req, nil); err == nil || requests != 1 {
+		t.Errorf("expected a single failed request, got %v requests and %v", requests, err)
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"thermostat-scheduler/internal/retry"
+	"time"
+)
+
+// An unsuccessful response from the BlueLink API. The more specific errors
+// below embed it, so it's available from all of them.
+type APIError struct {
+	StatusCode int
+	Status     string // e.g., "400 Bad Request"
+	Body       string // The body of the response, which usually explains the error.
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("request failed with: %s", e.Status)
+	}
+	return fmt.Sprintf("request failed with: %s: %s", e.Status, e.Body)
+}
+
+// The credentials or the session token were rejected.
+type UnauthorizedError struct{ APIError }
+
+// Too many requests were made. RetryAfter is how long the API asked to wait,
+// or zero when it didn't say.
+type RateLimitedError struct {
+	APIError
+	RetryAfter time.Duration
+}
+
+// The thermostat isn't connected, so it can't be updated.
+type DeviceOfflineError struct{ APIError }
+
+// The request was rejected as invalid, e.g., a program the thermostat doesn't
+// accept.
+type ValidationError struct{ APIError }
+
+// The API failed to handle the request.
+type ServerError struct{ APIError }
+
+// The most of a response body to keep in an error.
+const maxErrorBody = 4096
+
+// Returns the error for the unsuccessful response |resp|, reading its body.
+func newError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	e := APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+
+	lower := strings.ToLower(e.Body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &UnauthorizedError{e}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitedError{e, retry.After(resp.Header)}
+	case strings.Contains(lower, "offline") || strings.Contains(lower, "not connected"):
+		return &DeviceOfflineError{e}
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity:
+		return &ValidationError{e}
+	case resp.StatusCode >= 500:
+		return &ServerError{e}
+	}
+	return &e
+}
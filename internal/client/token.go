@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Keeps the session token between runs, so that logging in isn't needed on
+// every run.
+type TokenStore interface {
+	Load() (string, error) // Returns an empty token when none was saved.
+	Save(token string) error
+}
+
+// Returns a TokenStore that keeps the token of |username| on the API at
+// |baseURL| in the user's cache directory, readable only by the user.
+func NewFileTokenStore(baseURL, username string) (TokenStore, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	// Don't leak the username in the file name.
+	sum := sha256.Sum256([]byte(baseURL + "\n" + username))
+	return &fileTokenStore{
+		path: filepath.Join(cacheDir, "thermostat-scheduler", "token-"+hex.EncodeToString(sum[:8])),
+	}, nil
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (string, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *fileTokenStore) Save(token string) error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a partial token is never
+	// read, and so that the file is never readable by others.
+	file, err := os.CreateTemp(dir, ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.WriteString(token + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path)
+}
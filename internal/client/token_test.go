@@ -0,0 +1,32 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	s := &fileTokenStore{path: filepath.Join(t.TempDir(), "thermostat-scheduler", "token")}
+
+	token, err := s.Load()
+	if err != nil || token != "" {
+		t.Errorf("expected no token, got %q, %v", token, err)
+	}
+
+	if err := s.Save("Token abc"); err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.Load()
+	if err != nil || token != "Token abc" {
+		t.Errorf("expected the saved token, got %q, %v", token, err)
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected the token to only be readable by the user, got %v", perm)
+	}
+}
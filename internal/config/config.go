@@ -1,12 +1,16 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/url"
 	"strconv"
+	"strings"
 	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/retry"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -15,8 +19,8 @@ import (
 // A single event in a program.
 type DayEvent struct {
 	Time time.Duration // The time this event starts, as a duration from midnight, e.g., "14h"
-	Heat int           // The temperature to heat to.
-	Cool int           // The temperature to cool to.
+	Heat float64       // The temperature to heat to, e.g., 20.5
+	Cool float64       // The temperature to cool to.
 }
 
 // Copy other to this event.
@@ -26,23 +30,77 @@ func (d *DayEvent) Copy(other DayEvent) {
 	d.Cool = other.Cool
 }
 
+// Returns this event with its time as a duration string, e.g., "9h30m", as
+// in the config.
+func (d DayEvent) MarshalYAML() (interface{}, error) {
+	return dayEventText{FormatDuration(d.Time), d.Heat, d.Cool}, nil
+}
+
+func (d DayEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dayEventText{FormatDuration(d.Time), d.Heat, d.Cool})
+}
+
+func (d *DayEvent) UnmarshalJSON(data []byte) error {
+	var text dayEventText
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	t, err := time.ParseDuration(text.Time)
+	if err != nil {
+		return err
+	}
+	*d = DayEvent{Time: t, Heat: text.Heat, Cool: text.Cool}
+	return nil
+}
+
+// A DayEvent, as written in files.
+type dayEventText struct {
+	Time string  `yaml:"time" json:"time"`
+	Heat float64 `yaml:"heat" json:"heat"`
+	Cool float64 `yaml:"cool" json:"cool"`
+}
+
+// Returns |d| without its zero minutes and seconds, e.g., "7h" rather than
+// "7h0m0s".
+func FormatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
 // The program for a single day.
 type DailyProgram struct {
-	Morning DayEvent
-	Day     DayEvent
-	Evening DayEvent
-	Night   DayEvent
+	Morning DayEvent `yaml:"morning,flow" json:"morning"`
+	Day     DayEvent `yaml:"day,flow" json:"day"`
+	Evening DayEvent `yaml:"evening,flow" json:"evening"`
+	Night   DayEvent `yaml:"night,flow" json:"night"`
+}
+
+// A period of a DailyProgram, with its name, e.g., "morning".
+type Period struct {
+	Name  string
+	Event DayEvent
+}
+
+// Returns the periods of the day, in order.
+func (dp DailyProgram) Periods() []Period {
+	return []Period{{"morning", dp.Morning}, {"day", dp.Day}, {"evening", dp.Evening}, {"night", dp.Night}}
 }
 
 // The program for a whole week, one program per day.
 type WeeklyProgram struct {
-	Sunday    DailyProgram
-	Monday    DailyProgram
-	Tuesday   DailyProgram
-	Wednesday DailyProgram
-	Thursday  DailyProgram
-	Friday    DailyProgram
-	Saturday  DailyProgram
+	Sunday    DailyProgram `yaml:"sunday" json:"sunday"`
+	Monday    DailyProgram `yaml:"monday" json:"monday"`
+	Tuesday   DailyProgram `yaml:"tuesday" json:"tuesday"`
+	Wednesday DailyProgram `yaml:"wednesday" json:"wednesday"`
+	Thursday  DailyProgram `yaml:"thursday" json:"thursday"`
+	Friday    DailyProgram `yaml:"friday" json:"friday"`
+	Saturday  DailyProgram `yaml:"saturday" json:"saturday"`
 }
 
 // Returns the number of hours since midnight relative to |t|.
@@ -137,6 +195,11 @@ func (wp *WeeklyProgram) DayEventAfter(weekday time.Weekday, when time.Duration)
 }
 
 type PeakProgram struct {
+	// The strategy that decides the temperatures around peak events, one of
+	// offset, absolute, coast or staged. Defaults to absolute when absolute
+	// temperatures are set, and to offset otherwise.
+	Strategy string `yaml:"strategy"`
+
 	// How long to pre-heat before a peak event, e.g., "1h"
 	// Careful not to overlap the previous event with an overly long
 	// pre-heating.
@@ -145,22 +208,97 @@ type PeakProgram struct {
 	// How long before and after the peak event to keep the peak temperature to
 	// account for potential clock drift, e.g., "2m"
 	//
-	// TODO: It seems as though the thermostat always rounds down to the nearest
-	// 10 minute, e.g, 18m->10m, so this doesn't work as expected.
+	// The thermostat rounds times down to its time step, e.g., 18m->10m, so
+	// the buffered peak period is widened to whole time steps.
 	PeakBufferDuration time.Duration `yaml:"peak_buffer"`
 
+	// Whether to maintain the normal temperature of the peak period before the
+	// pre-heat period. This makes it so we don't need to heat as much during
+	// pre-heating.
+	MaintainNormalTempBeforePreHeat bool `yaml:"maintain_normal_temp_before_preheat"`
+
+	// How long to pre-cool before a cooling peak event, e.g., "1h"
+	PreCoolDuration time.Duration `yaml:"pre_cool_duration"`
+
+	// The months during which peak events are cooling events, e.g., [6, 7, 8]
+	CoolingMonths []time.Month `yaml:"cooling_months"`
+
+	// The offers whose peak events are cooling events, regardless of the
+	// month, e.g., ["ETE"]
+	CoolingOffers []string `yaml:"cooling_offers"`
+
+	// The offset strategy is configured at the top level, since it predates
+	// the other strategies.
+
 	// How much to change the temperature by during pre-heating, relative to
 	// the normal program temperature at the start of the peak event, e.g., 2
-	PreHeatTempOffset int `yaml:"pre_heat_temp_offset"`
+	PreHeatTempOffset float64 `yaml:"pre_heat_temp_offset"`
 
 	// How much to change the temperature during the peak event, relative to the
 	// normal program temperature at the start of the peak event, e.g., -1
-	PeakTempOffset int `yaml:"peak_temp_offset"`
+	PeakTempOffset float64 `yaml:"peak_temp_offset"`
+
+	// How much to change the cooling temperature by during pre-cooling,
+	// relative to the normal program temperature at the start of the peak
+	// event, e.g., -2
+	PreCoolTempOffset float64 `yaml:"pre_cool_temp_offset"`
+
+	// How much to change the cooling temperature during a cooling peak event,
+	// relative to the normal program temperature at the start of the peak
+	// event, e.g., 2
+	PeakCoolTempOffset float64 `yaml:"peak_cool_temp_offset"`
+
+	// The range to keep the offset temperatures within, e.g., 17 and 23. Zero
+	// leaves that side unbounded. The other strategies have their own, e.g.,
+	// coast.min_temp.
+	MinTemp float64 `yaml:"min_temp"`
+	MaxTemp float64 `yaml:"max_temp"`
+
+	// The range to keep the offset cooling temperatures within, e.g., 21
+	// and 28. Zero leaves that side unbounded.
+	MinCoolTemp float64 `yaml:"min_cool_temp"`
+	MaxCoolTemp float64 `yaml:"max_cool_temp"`
+
+	// The temperatures of the absolute strategy can also be set at the top
+	// level, as a shorthand for its block. Once the config is read, they are
+	// moved to the block.
+	PreHeatTemp  float64 `yaml:"pre_heat_temp"`
+	PeakTemp     float64 `yaml:"peak_temp"`
+	PreCoolTemp  float64 `yaml:"pre_cool_temp"`
+	PeakCoolTemp float64 `yaml:"peak_cool_temp"`
+
+	// The configuration of the other strategies.
+	Absolute AbsoluteStrategy `yaml:"absolute"`
+	Coast    CoastStrategy    `yaml:"coast"`
+	Staged   StagedStrategy   `yaml:"staged"`
+}
 
-	// Whether to maintain the normal temperature of the peak period before the
-	// pre-heat period. This makes it so we don't need to heat as much during
-	// pre-heating.
-	MaintainNormalTempBeforePreHeat bool `yaml:"maintain_normal_temp_before_preheat"`
+// Returns the name of the selected strategy, inferring it when it isn't set.
+func (p PeakProgram) StrategyName() string {
+	if p.Strategy != "" {
+		return p.Strategy
+	}
+	if p.hasAbsoluteTemps() {
+		return AbsoluteStrategyName
+	}
+	return OffsetStrategyName
+}
+
+// Returns whether a peak event for |offer| that starts at |start| is a
+// cooling event, which adjusts the cooling rather than the heating
+// temperature.
+func (p PeakProgram) IsCoolingEvent(offer string, start time.Time) bool {
+	for _, o := range p.CoolingOffers {
+		if o == offer {
+			return true
+		}
+	}
+	for _, m := range p.CoolingMonths {
+		if m == start.Month() {
+			return true
+		}
+	}
+	return false
 }
 
 type Config struct {
@@ -171,13 +309,94 @@ type Config struct {
 	// E.g., https://donnees.solutions.hydroquebec.com/donnees-ouvertes/data/json/pointeshivernales.json
 	PeakEventsUrl string `yaml:"peak_events_url"`
 
+	// The URL of the BlueLink API. Defaults to the official one, but can
+	// point to a fake one, e.g., for testing.
+	BlueLinkUrl string `yaml:"bluelink_url"`
+
 	// The normal every day program.
 	NormalProgram WeeklyProgram `yaml:"normal_program"`
 
 	// How to modify the program during peak events.
 	PeakProgram PeakProgram `yaml:"peak_program"`
+
+	// How far ahead to plan for upcoming peak events, e.g., "72h". Defaults
+	// to MaxLookahead when unset, and can't be 0. Once the config is read,
+	// this is always set.
+	Lookahead *time.Duration `yaml:"lookahead"`
+
+	// The scale of the temperatures in this config, celsius or fahrenheit.
+	// Defaults to celsius.
+	Units Units `yaml:"units"`
+
+	// The scale the thermostat itself is set to, celsius or fahrenheit.
+	// Defaults to celsius.
+	DeviceUnits Units `yaml:"device_units"`
+	// What the thermostat supports. Defaults to the capabilities of its
+	// model.
+	Device Capabilities `yaml:"device"`
+
+	// How to retry the requests to BlueLink and Hydro-Quebec that fail
+	// transiently.
+	Retry retry.Policy `yaml:"retry"`
+
+	// When the daemon runs.
+	Daemon Daemon `yaml:"daemon"`
+
+	// Where to publish the metrics of the scheduler.
+	Metrics Metrics `yaml:"metrics"`
+
+	// Where to serve the dashboard.
+	Dashboard Dashboard `yaml:"dashboard"`
+
+	// The thermostats to program, each with its own programs. When none are
+	// declared, the account's thermostat is programmed with the top-level
+	// programs. Once the config is read, this always has at least one
+	// thermostat.
+	Thermostats []Thermostat `yaml:"thermostats"`
+
+	// Whether BlueLinkUrl is a local fake, to try the config. The session
+	// token, the events already seen and the last success are then left
+	// alone, since they belong to the actual thermostats.
+	FakeThermostat bool `yaml:"-"`
+}
+
+// When the daemon runs, on top of when the program must change.
+type Daemon struct {
+	// How often to refresh the peak events and update the programs, e.g.,
+	// "1h". Defaults to 1h.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// How long before pre-heating starts to update the programs, to make sure
+	// that the thermostats have the latest one, e.g., "15m". Defaults to 15m.
+	WakeBefore time.Duration `yaml:"wake_before"`
+}
+
+// Where to publish the metrics of the scheduler, in the Prometheus format.
+type Metrics struct {
+	// The address to serve the metrics on, at /metrics, when running as a
+	// daemon, e.g., "127.0.0.1:9842". Empty to not serve them.
+	ListenAddress string `yaml:"listen_address"`
+
+	// The file to write the metrics to after every run, for the
+	// node_exporter textfile collector, e.g.,
+	// "/var/lib/node_exporter/textfile_collector/thermostat_scheduler.prom".
+	// Empty to not write them.
+	Textfile string `yaml:"textfile"`
+}
+
+// Where to serve the dashboard and its API.
+type Dashboard struct {
+	// The address to serve the dashboard on, e.g., "localhost:8080". Defaults
+	// to localhost:8080, which can only be reached from this machine.
+	ListenAddress string `yaml:"listen_address"`
 }
 
+// The furthest ahead peak events can be planned for. The weekly program has
+// one day for today and each of the next six days, the last of which shares
+// its program with yesterday, whose night is still running until today's
+// first period.
+const MaxLookahead = 6 * 24 * time.Hour
+
 // Read and validate the config from reader.
 func ReadConfig(reader io.Reader) (Config, error) {
 	var c Config
@@ -201,20 +420,99 @@ func validate(c Config) (Config, error) {
 	if _, err := url.ParseRequestURI(c.PeakEventsUrl); err != nil {
 		return c, fmt.Errorf("invalid peak_events_url: %w", err)
 	}
-	err := validateWeeklyProgram(c.NormalProgram)
+	if c.BlueLinkUrl != "" {
+		if _, err := url.ParseRequestURI(c.BlueLinkUrl); err != nil {
+			return c, fmt.Errorf("invalid bluelink_url: %w", err)
+		}
+	}
+	for _, u := range []*Units{&c.Units, &c.DeviceUnits} {
+		if *u == "" {
+			*u = Celsius
+		}
+		if *u != Celsius && *u != Fahrenheit {
+			return c, fmt.Errorf("units should be celsius or fahrenheit, got %q", *u)
+		}
+	}
+	device, err := c.Device.withDefaults(c.Units)
 	if err != nil {
-		return c, fmt.Errorf("invalid weekly program: %w", err)
+		return c, fmt.Errorf("invalid device: %w", err)
 	}
-	err = validatePeakProgram(c.PeakProgram)
+	c.Device = device
+	thermostats, err := validateThermostats(c)
 	if err != nil {
-		return c, fmt.Errorf("invalid peak program: %w", err)
+		return c, err
+	}
+	c.Thermostats = thermostats
+	c.Retry, err = validateRetryPolicy(c.Retry)
+	if err != nil {
+		return c, fmt.Errorf("invalid retry policy: %w", err)
+	}
+	c.Daemon, err = validateDaemon(c.Daemon)
+	if err != nil {
+		return c, fmt.Errorf("invalid daemon: %w", err)
+	}
+	if c.Metrics.Textfile != "" && !strings.HasSuffix(c.Metrics.Textfile, ".prom") {
+		return c, fmt.Errorf("metrics textfile should end with .prom to be collected, got %v", c.Metrics.Textfile)
+	}
+	if c.Dashboard.ListenAddress == "" {
+		c.Dashboard.ListenAddress = "localhost:8080"
+	}
+	if c.Lookahead == nil {
+		lookahead := MaxLookahead
+		c.Lookahead = &lookahead
+	}
+	if *c.Lookahead <= 0 || *c.Lookahead > MaxLookahead {
+		return c, fmt.Errorf("lookahead should be more than 0s and at most %v, or left out for the most, got %v", MaxLookahead, *c.Lookahead)
 	}
 	return c, nil
 }
 
-func validateWeeklyProgram(p WeeklyProgram) error {
+// Fills in the defaults of the retry policy, and validates it.
+func validateRetryPolicy(p retry.Policy) (retry.Policy, error) {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = 2 * time.Second
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.Deadline == 0 {
+		p.Deadline = 2 * time.Minute
+	}
+	if p.MaxAttempts < 1 || p.MaxAttempts > 10 {
+		return p, fmt.Errorf("max attempts should be between 1 and 10, got %v", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return p, fmt.Errorf("backoff should be positive and at most the max backoff, got %v and %v", p.InitialBackoff, p.MaxBackoff)
+	}
+	if p.Deadline < 0 {
+		return p, fmt.Errorf("deadline should be positive, got %v", p.Deadline)
+	}
+	return p, nil
+}
+
+// Fills in the defaults of the daemon, and validates it.
+func validateDaemon(d Daemon) (Daemon, error) {
+	if d.RefreshInterval == 0 {
+		d.RefreshInterval = time.Hour
+	}
+	if d.WakeBefore == 0 {
+		d.WakeBefore = 15 * time.Minute
+	}
+	if d.RefreshInterval < time.Minute {
+		return d, fmt.Errorf("refresh_interval should be at least 1m, got %v", d.RefreshInterval)
+	}
+	if d.WakeBefore < 0 {
+		return d, fmt.Errorf("wake_before should be positive, got %v", d.WakeBefore)
+	}
+	return d, nil
+}
+
+func validateWeeklyProgram(p WeeklyProgram, u Units) error {
 	for _, dp := range []DailyProgram{p.Sunday, p.Monday, p.Tuesday, p.Wednesday, p.Thursday, p.Friday, p.Saturday} {
-		err := validateDailyProgram(dp)
+		err := validateDailyProgram(dp, u)
 		if err != nil {
 			return err
 		}
@@ -222,10 +520,10 @@ func validateWeeklyProgram(p WeeklyProgram) error {
 	return nil
 }
 
-func validateDailyProgram(p DailyProgram) error {
+func validateDailyProgram(p DailyProgram, u Units) error {
 	// First, validate that each day event is valid.
 	for _, e := range []DayEvent{p.Morning, p.Day, p.Evening, p.Night} {
-		err := validateDayEvent(e)
+		err := validateDayEvent(e, u)
 		if err != nil {
 			return err
 		}
@@ -242,39 +540,96 @@ func validateDailyProgram(p DailyProgram) error {
 	return nil
 }
 
-func validateDayEvent(e DayEvent) error {
+func validateDayEvent(e DayEvent, u Units) error {
 	if e.Time < 0 || e.Time > 24*time.Hour {
 		return fmt.Errorf("event time must be between 0s and 24h, got: %v", e)
 	}
 	// Losely enforce that the temperature are within acceptable ranges.
-	if e.Heat < 0 || e.Heat > 50 {
-		return fmt.Errorf("event heat must be between 0C and 50C, got: %v", e)
+	if err := u.checkTemp("event heat", e.Heat, 0, 50); err != nil {
+		return err
 	}
-	if e.Cool < 0 || e.Cool > 50 {
-		return fmt.Errorf("event cool must be between 0C and 50C, got: %v", e)
+	if err := u.checkTemp("event cool", e.Cool, 0, 50); err != nil {
+		return err
 	}
 	return nil
 }
 
-func validatePeakProgram(p PeakProgram) error {
+// Validates |p|, moving the absolute temps set at the top level to the
+// absolute block.
+func validatePeakProgram(p PeakProgram, u Units) (PeakProgram, error) {
 	// Loosely enforce that the peak program values are within acceptable ranges.
 	if p.PreHeatDuration < 0 || p.PreHeatDuration > 2*time.Hour {
-		return fmt.Errorf("pre-heat duration should be between 0s and 2h, got %v", p.PreHeatDuration)
+		return p, fmt.Errorf("pre-heat duration should be between 0s and 2h, got %v", p.PreHeatDuration)
 	}
 	if p.PeakBufferDuration < 0 || p.PeakBufferDuration > 10*time.Minute {
-		return fmt.Errorf("peak buffer duration should be between 0s and 10m, got %v", p.PeakBufferDuration)
+		return p, fmt.Errorf("peak buffer duration should be between 0s and 10m, got %v", p.PeakBufferDuration)
 	}
-	if p.PreHeatTempOffset < 0 || p.PreHeatTempOffset > 10 {
-		return fmt.Errorf("pre-heat temp offset should be between 0C and 10C, got %v", p.PreHeatTempOffset)
+	if p.PreCoolDuration < 0 || p.PreCoolDuration > 2*time.Hour {
+		return p, fmt.Errorf("pre-cool duration should be between 0s and 2h, got %v", p.PreCoolDuration)
 	}
-	if p.PeakTempOffset < -10 || p.PeakTempOffset > 0 {
-		return fmt.Errorf("peak temp offset should be between -10C and 0C, got %v", p.PeakTempOffset)
+	for _, m := range p.CoolingMonths {
+		if m < time.January || m > time.December {
+			return p, fmt.Errorf("cooling months should be between 1 and 12, got %v", int(m))
+		}
 	}
-	return nil
+
+	// The absolute temps can be set either in their block or at the top
+	// level, but not both, or some would be ignored.
+	if top := p.topLevelAbsoluteTemps(); top != (AbsoluteStrategy{}) {
+		if p.Absolute != (AbsoluteStrategy{}) {
+			return p, errors.New("absolute temps should be set either in the absolute block or at the top level, not both")
+		}
+		p.Absolute = top
+		p.PreHeatTemp, p.PeakTemp, p.PreCoolTemp, p.PeakCoolTemp = 0, 0, 0, 0
+	}
+
+	// The offset strategy shares the top level with the others' shorthands,
+	// so make sure that the config doesn't mix them.
+	if p.hasOffsets() && p.hasAbsoluteTemps() {
+		return p, errors.New("temp offsets and absolute temps can't be mixed")
+	}
+	if name := p.StrategyName(); p.hasOffsets() && name != OffsetStrategyName {
+		return p, fmt.Errorf("temp offsets at the top level only apply to the offset strategy, not %v, which has its own settings in its block", name)
+	}
+	if name := p.StrategyName(); p.hasClamps() && name != OffsetStrategyName {
+		return p, fmt.Errorf("min and max temps only apply to the offset strategy, not %v, which has its own settings in its block", name)
+	}
+	// Likewise, the blocks of the other strategies would be ignored.
+	for _, block := range p.strategyBlocks() {
+		if name := p.StrategyName(); block != name {
+			return p, fmt.Errorf("the %v block only applies to the %v strategy, not %v", block, block, name)
+		}
+	}
+
+	// Then, validate the configuration of the selected strategy.
+	switch p.StrategyName() {
+	case OffsetStrategyName:
+		return p, validateOffsetStrategy(p, u)
+	case AbsoluteStrategyName:
+		return p, p.Absolute.validate(u)
+	case CoastStrategyName:
+		return p, p.Coast.validate(u)
+	case StagedStrategyName:
+		return p, p.Staged.validate(u)
+	}
+	return p, fmt.Errorf("unknown strategy %q", p.Strategy)
 }
 
-// Converts this WeeklyProgram to the API's StateData.
-func (wp WeeklyProgram) ToStateData() api.StateData {
+// Converts this WeeklyProgram, in |units|, to the API's StateData for a
+// thermostat set to |deviceUnits| with capabilities |caps|. The program is
+// fitted to what the thermostat supports, and the adjustments that required
+// are returned along with the StateData.
+func (wp WeeklyProgram) ToStateData(units, deviceUnits Units, caps Capabilities) (api.StateData, []Adjustment, error) {
+	var adjustments []Adjustment
+	for _, weekday := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday,
+		time.Thursday, time.Friday, time.Saturday, time.Sunday} {
+		dp, a, err := wp.DailyProgramOn(weekday).fit(weekday, units, deviceUnits, caps)
+		if err != nil {
+			return api.StateData{}, nil, err
+		}
+		*wp.DailyProgramOn(weekday) = dp
+		adjustments = append(adjustments, a...)
+	}
 	return api.StateData{
 		Program1: wp.Monday.ToProgramString(),
 		Program2: wp.Tuesday.ToProgramString(),
@@ -283,10 +638,11 @@ func (wp WeeklyProgram) ToStateData() api.StateData {
 		Program5: wp.Friday.ToProgramString(),
 		Program6: wp.Saturday.ToProgramString(),
 		Program7: wp.Sunday.ToProgramString(),
-	}
+	}, adjustments, nil
 }
 
-// Returns the string that represents this DailyProgam in the API.
+// Returns the string that represents this DailyProgam in the API. The
+// temperatures must already be in the thermostat's scale.
 func (dp DailyProgram) ToProgramString() string {
 	return dp.Morning.ToProgramHeatStringPart() +
 		dp.Day.ToProgramHeatStringPart() +
@@ -301,17 +657,24 @@ func (dp DailyProgram) ToProgramString() string {
 // Returns the heat part of the DayEvent string.
 func (de DayEvent) ToProgramHeatStringPart() string {
 	start := time.Time{}.Add(de.Time)
-	return fmt.Sprintf("%02d%02d%03d", start.Hour(), start.Minute(), int(de.Heat*10))
+	return fmt.Sprintf("%02d%02d%03d", start.Hour(), start.Minute(), toTenths(de.Heat))
 }
 
 // Returns the cool part of the DayEvent string.
 func (de DayEvent) ToProgramCoolStringPart() string {
 	start := time.Time{}.Add(de.Time)
-	return fmt.Sprintf("%02d%02d%03d", start.Hour(), start.Minute(), int(de.Cool*10))
+	return fmt.Sprintf("%02d%02d%03d", start.Hour(), start.Minute(), toTenths(de.Cool))
 }
 
-func ToWeeklyProgram(s api.StateData) WeeklyProgram {
-	return WeeklyProgram{
+// Returns |temp| in tenths of a degree, as the API expects.
+func toTenths(temp float64) int {
+	return int(math.Round(temp * 10))
+}
+
+// Returns the WeeklyProgram that the API's StateData represents, for a
+// thermostat set to |deviceUnits|, with temperatures converted to |units|.
+func ToWeeklyProgram(s api.StateData, deviceUnits, units Units) WeeklyProgram {
+	wp := WeeklyProgram{
 		Monday:    parseDailyProgram(s.Program1),
 		Tuesday:   parseDailyProgram(s.Program2),
 		Wednesday: parseDailyProgram(s.Program3),
@@ -320,6 +683,22 @@ func ToWeeklyProgram(s api.StateData) WeeklyProgram {
 		Saturday:  parseDailyProgram(s.Program6),
 		Sunday:    parseDailyProgram(s.Program7),
 	}
+	return wp.Convert(deviceUnits, units)
+}
+
+// Returns this WeeklyProgram with its temperatures converted from |from| to
+// |to|. A single decimal is kept, so that converted temperatures stay
+// readable.
+func (wp WeeklyProgram) Convert(from, to Units) WeeklyProgram {
+	for _, weekday := range []time.Weekday{time.Sunday, time.Monday, time.Tuesday,
+		time.Wednesday, time.Thursday, time.Friday, time.Saturday} {
+		dp := wp.DailyProgramOn(weekday)
+		for _, e := range []*DayEvent{&dp.Morning, &dp.Day, &dp.Evening, &dp.Night} {
+			e.Heat = math.Round(from.Convert(e.Heat, to)*10) / 10
+			e.Cool = math.Round(from.Convert(e.Cool, to)*10) / 10
+		}
+	}
+	return wp
 }
 
 func parseDailyProgram(s string) DailyProgram {
@@ -341,7 +720,7 @@ func parseDayEvent(heating string, cooling string) DayEvent {
 	cool, _ := strconv.Atoi(cooling[4:7])
 	return DayEvent{
 		Time: time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute,
-		Heat: heat / 10,
-		Cool: cool / 10,
+		Heat: float64(heat) / 10,
+		Cool: float64(cool) / 10,
 	}
 }
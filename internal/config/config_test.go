@@ -1,9 +1,10 @@
-
 package config
 
 import (
 	"strings"
 	"testing"
+	"thermostat-scheduler/internal/api"
+	"time"
 )
 
 func TestReadConfig(t *testing.T) {
@@ -37,6 +38,385 @@ peak_program:
 `,
 			wantErr: false,
 		},
+		{
+			name: "cooling peak program",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  pre_cool_duration: 1h
+  pre_cool_temp_offset: -2
+  peak_cool_temp_offset: 2
+  cooling_months: [6, 7, 8]
+`,
+			wantErr: false,
+		},
+		{
+			name: "negative peak cool temp offset",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  peak_cool_temp_offset: -2
+`,
+			wantErr: true,
+		},
+		{
+			name: "absolute temps",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  pre_heat_duration: 1h
+  pre_heat_temp: 22
+  peak_temp: 17
+`,
+			wantErr: false,
+		},
+		{
+			name: "absolute block",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  pre_heat_duration: 1h
+  strategy: absolute
+  absolute:
+    pre_heat_temp: 22
+    peak_temp: 17
+`,
+			wantErr: false,
+		},
+		{
+			name: "absolute block and top-level absolute temps",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  pre_heat_temp: 22
+  absolute:
+    peak_temp: 17
+`,
+			wantErr: true,
+		},
+		{
+			name: "absolute temps mixed with offsets",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  pre_heat_temp_offset: 1
+  peak_temp: 17
+`,
+			wantErr: true,
+		},
+		{
+			name: "clamped offsets",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  peak_temp_offset: -3
+  min_temp: 18
+`,
+			wantErr: false,
+		},
+		{
+			name: "coast block with the offset strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: offset
+  peak_temp_offset: -2
+  coast:
+    min_temp: 15
+`,
+			wantErr: true,
+		},
+		{
+			name: "absolute block with the offset strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: offset
+  absolute:
+    peak_temp: 17
+`,
+			wantErr: true,
+		},
+		{
+			name: "top-level offsets with the staged strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: staged
+  peak_temp_offset: -2
+  staged:
+    steps:
+      - { after: 0s, temp_offset: -1 }
+`,
+			wantErr: true,
+		},
+		{
+			name: "top-level min temp with the coast strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: coast
+  min_temp: 15
+  coast:
+    min_temp: 15
+`,
+			wantErr: true,
+		},
+		{
+			name: "min temp with absolute temps",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  peak_temp: 17
+  min_temp: 15
+`,
+			wantErr: true,
+		},
+		{
+			name: "staged strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: staged
+  pre_heat_duration: 1h
+  staged:
+    pre_heat_temp_offset: 2
+    steps:
+      - { after: 0s, temp_offset: -1 }
+      - { after: 2h, temp_offset: -2 }
+`,
+			wantErr: false,
+		},
+		{
+			name: "coast strategy without a min temp",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: coast
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown strategy",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  strategy: magic
+`,
+			wantErr: true,
+		},
+		{
+			name: "lookahead beyond the weekly program",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+lookahead: 168h
+`,
+			wantErr: true,
+		},
+		{
+			name: "no lookahead",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+lookahead: 0s
+`,
+			wantErr: true,
+		},
+		{
+			name: "fahrenheit",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+units: fahrenheit
+device_units: fahrenheit
+normal_program:
+  sunday: &default_program
+    morning: { time: 7h, heat: 70, cool: 76 }
+    day:     { time: 9h, heat: 70, cool: 76 }
+    evening: { time: 16h, heat: 70, cool: 76 }
+    night:   { time: 21h, heat: 68, cool: 77 }
+  monday: *default_program
+  tuesday: *default_program
+  wednesday: *default_program
+  thursday: *default_program
+  friday: *default_program
+  saturday: *default_program
+peak_program:
+  pre_heat_duration: 1h
+  pre_heat_temp_offset: 15
+  peak_temp_offset: -5
+`,
+			wantErr: false,
+		},
+		{
+			name: "fahrenheit temps in a celsius config",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+normal_program:
+  sunday:
+    morning: { time: 7h, heat: 70, cool: 76 }
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown units",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+units: kelvin
+`,
+			wantErr: true,
+		},
+		{
+			name: "device capabilities",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+device:
+  model: bluelink
+  time_step: 15m
+  periods: 2
+`,
+			wantErr: false,
+		},
+		{
+			name: "normal program with more periods than the thermostat",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+device:
+  periods: 2
+normal_program:
+  monday:
+    morning: { time: 7h, heat: 21, cool: 24 }
+    day:     { time: 9h, heat: 20, cool: 24 }
+    evening: { time: 16h, heat: 21, cool: 24 }
+    night:   { time: 21h, heat: 20, cool: 25 }
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown device model",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+device:
+  model: nest
+`,
+			wantErr: true,
+		},
+		{
+			name: "too many periods",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+device:
+  periods: 6
+`,
+			wantErr: true,
+		},
+		{
+			name: "thermostat without a uuid or name",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+thermostats:
+  - peak_program:
+      peak_temp_offset: -1
+`,
+			wantErr: true,
+		},
+		{
+			name: "normal program outside of thermostats",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+normal_program:
+  sunday:
+    morning: { time: 7h, heat: 21, cool: 24 }
+thermostats:
+  - name: Upstairs
+`,
+			wantErr: true,
+		},
+		{
+			name: "peak program outside of thermostats",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  peak_temp_offset: -1
+thermostats:
+  - name: Upstairs
+`,
+			wantErr: true,
+		},
+		{
+			name: "daemon refreshing too often",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+daemon:
+  refresh_interval: 10s
+`,
+			wantErr: true,
+		},
+		{
+			name: "metrics textfile that isn't collected",
+			config: `
+username: user
+password: password
+peak_events_url: "https://example.com"
+metrics:
+  textfile: /var/lib/node_exporter/thermostat_scheduler.txt
+`,
+			wantErr: true,
+		},
 		{
 			name: "invalid peak_events_url",
 			config: `
@@ -65,3 +445,204 @@ password: password
 		})
 	}
 }
+
+func TestStateDataRoundTrip(t *testing.T) {
+	dp := DailyProgram{
+		Morning: DayEvent{Time: 7 * time.Hour, Heat: 20.5, Cool: 24},
+		Day:     DayEvent{Time: 9*time.Hour + 30*time.Minute, Heat: 19, Cool: 25.5},
+		Evening: DayEvent{Time: 16 * time.Hour, Heat: 21.5, Cool: 24},
+		Night:   DayEvent{Time: 21 * time.Hour, Heat: 18.5, Cool: 26},
+	}
+	wp := WeeklyProgram{
+		Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+		Thursday: dp, Friday: dp, Saturday: dp,
+	}
+
+	caps, err := Capabilities{}.withDefaults(Celsius)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, adjustments, err := wp.ToStateData(Celsius, Celsius, caps)
+	if err != nil || len(adjustments) != 0 {
+		t.Errorf("expected no adjustments, got %v, %v", adjustments, err)
+	}
+	if want := "07002050930190160021521001850700240093025516002402100260"; sd.Program1 != want {
+		t.Errorf("want %v, got %v", want, sd.Program1)
+	}
+	if got := ToWeeklyProgram(sd, Celsius, Celsius); got != wp {
+		t.Errorf("want\n%v, got\n%v", wp, got)
+	}
+
+	// Temperatures are converted to the thermostat's scale, and rounded to the
+	// nearest half degree in Celsius or whole degree in Fahrenheit.
+	tests := []struct {
+		temp              float64
+		units, deviceUnit Units
+		want              string
+	}{
+		{20.2, Celsius, Celsius, "0700200"},
+		{20.3, Celsius, Celsius, "0700205"},
+		{20.75, Celsius, Celsius, "0700210"},
+		{20, Celsius, Fahrenheit, "0700680"},
+		{20.5, Celsius, Fahrenheit, "0700690"},
+		{68, Fahrenheit, Fahrenheit, "0700680"},
+		{69, Fahrenheit, Celsius, "0700205"},
+	}
+	for _, tt := range tests {
+		caps, err := Capabilities{}.withDefaults(tt.units)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dp := DailyProgram{Morning: DayEvent{Time: 7 * time.Hour, Heat: tt.temp}}
+		sd, _, err := WeeklyProgram{Monday: dp}.ToStateData(tt.units, tt.deviceUnit, caps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sd.Program1[:7]; got != tt.want {
+			t.Errorf("for %v %v on a %v thermostat, want %v, got %v", tt.temp, tt.units, tt.deviceUnit, tt.want, got)
+		}
+	}
+
+	// Reading back from a thermostat in Fahrenheit keeps a single decimal.
+	caps, _ = Capabilities{}.withDefaults(Fahrenheit)
+	sd, _, _ = WeeklyProgram{Monday: DailyProgram{Morning: DayEvent{Heat: 69, Cool: 75}}}.ToStateData(Fahrenheit, Fahrenheit, caps)
+	if got := ToWeeklyProgram(sd, Fahrenheit, Celsius).Monday.Morning.Heat; got != 20.6 {
+		t.Errorf("want 20.6, got %v", got)
+	}
+}
+
+func TestStateDataCapabilities(t *testing.T) {
+	caps, err := Capabilities{}.withDefaults(Celsius)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := DailyProgram{
+		Morning: DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     DayEvent{Time: 9*time.Hour + 2*time.Minute, Heat: 35, Cool: 40},
+		Evening: DayEvent{Time: 16 * time.Hour, Heat: 22, Cool: 22.5},
+		Night:   DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	wp := WeeklyProgram{
+		Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+		Thursday: dp, Friday: dp, Saturday: dp,
+	}
+
+	// Times are rounded down to the time step, temperatures are clamped, and
+	// the cooling temperature is raised to respect the deadband.
+	sd, adjustments, err := wp.ToStateData(Celsius, Celsius, caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "07002100900320160022021002000700240090037016002352100250"; sd.Program1 != want {
+		t.Errorf("want %v, got %v", want, sd.Program1)
+	}
+	want := []string{
+		"Monday day time: wanted 9h2m0s, got 9h0m0s",
+		"Monday day heat: wanted 35C, got 32C",
+		"Monday day cool: wanted 40C, got 37C",
+		"Monday evening cool: wanted 22.5C, got 23.5C",
+	}
+	if len(adjustments) != 7*len(want) {
+		t.Fatalf("expected %v adjustments, got %v", 7*len(want), adjustments)
+	}
+	for i, w := range want {
+		if got := adjustments[i].String(); got != w {
+			t.Errorf("want %v, got %v", w, got)
+		}
+	}
+
+	// When rounding to a thermostat in Fahrenheit brings the temperatures
+	// closer than the deadband, and the cooling one is already as high as it
+	// goes, the heating one is lowered.
+	capped := caps
+	capped.MaxCool = 25.2
+	sd, _, err = WeeklyProgram{Monday: DailyProgram{Morning: DayEvent{Heat: 24, Cool: 26}}}.ToStateData(Celsius, Fahrenheit, capped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ToWeeklyProgram(sd, Fahrenheit, Fahrenheit).Monday.Morning; got.Heat != 74 || got.Cool != 77 {
+		t.Errorf("want 74F and 77F, got %vF and %vF", got.Heat, got.Cool)
+	}
+
+	// A program with more periods than the thermostat supports is rejected.
+	caps.Periods = 2
+	if _, _, err := wp.ToStateData(Celsius, Celsius, caps); err == nil {
+		t.Errorf("expected an error for too many periods")
+	}
+}
+
+func TestReadConfigThermostats(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader(`
+username: user
+password: password
+peak_events_url: "https://example.com"
+device_units: fahrenheit
+thermostats:
+  - name: Upstairs
+    normal_program:
+      sunday: &upstairs
+        morning: { time: 7h, heat: 21, cool: 24 }
+        day:     { time: 9h, heat: 21, cool: 24 }
+        evening: { time: 16h, heat: 21, cool: 24 }
+        night:   { time: 21h, heat: 20, cool: 25 }
+      monday: *upstairs
+      tuesday: *upstairs
+      wednesday: *upstairs
+      thursday: *upstairs
+      friday: *upstairs
+      saturday: *upstairs
+    peak_program:
+      peak_temp_offset: -1
+  - uuid: abc-123
+    device_units: celsius
+    device:
+      time_step: 15m
+    peak_program:
+      peak_temp: 17
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Thermostats) != 2 {
+		t.Fatalf("expected 2 thermostats, got %v", cfg.Thermostats)
+	}
+
+	// The device settings default to the top-level ones.
+	upstairs, other := cfg.Thermostats[0], cfg.Thermostats[1]
+	if upstairs.DeviceUnits != Fahrenheit || upstairs.Device.TimeStep != 10*time.Minute {
+		t.Errorf("expected the top-level device settings, got %v and %v", upstairs.DeviceUnits, upstairs.Device)
+	}
+	if other.DeviceUnits != Celsius || other.Device.TimeStep != 15*time.Minute || other.Device.Periods != 4 {
+		t.Errorf("expected the thermostat's own device settings, got %v and %v", other.DeviceUnits, other.Device)
+	}
+
+	// Thermostats are matched by UUID or name.
+	if !upstairs.Matches(api.Device{UUID: "def-456", Name: "Upstairs"}) || upstairs.Matches(api.Device{Name: "Basement"}) {
+		t.Errorf("expected to match by name")
+	}
+	if !other.Matches(api.Device{UUID: "abc-123", Name: "Basement"}) || other.Matches(api.Device{UUID: "def-456"}) {
+		t.Errorf("expected to match by UUID")
+	}
+
+	// The config for a thermostat uses its programs.
+	forOther := cfg.ForThermostat(other)
+	if forOther.PeakProgram.Absolute.PeakTemp != 17 || forOther.NormalProgram != (WeeklyProgram{}) {
+		t.Errorf("expected the thermostat's programs, got %v", forOther)
+	}
+
+	// Without thermostats, the top-level programs are used for any device.
+	cfg, err = ReadConfig(strings.NewReader(`
+username: user
+password: password
+peak_events_url: "https://example.com"
+peak_program:
+  peak_temp_offset: -1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Thermostats) != 1 || cfg.Thermostats[0].PeakProgram.PeakTempOffset != -1 ||
+		!cfg.Thermostats[0].Matches(api.Device{UUID: "abc-123"}) {
+		t.Errorf("expected a single thermostat with the top-level programs, got %v", cfg.Thermostats)
+	}
+}
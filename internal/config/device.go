@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The number of periods in a DailyProgram, which is the most any thermostat
+// supports.
+const MaxPeriods = 4
+
+// What a thermostat model supports. The temperatures are in the config's
+// units once the config is read, and a zero value leaves the model's default.
+type Capabilities struct {
+	// The thermostat model, which provides the defaults for the other fields.
+	// Defaults to bluelink.
+	Model string `yaml:"model"`
+
+	// The thermostat rounds times down to a multiple of this, e.g., "10m".
+	TimeStep time.Duration `yaml:"time_step"`
+
+	// The range of heating and cooling temperatures the thermostat accepts.
+	MinHeat float64 `yaml:"min_heat"`
+	MaxHeat float64 `yaml:"max_heat"`
+	MinCool float64 `yaml:"min_cool"`
+	MaxCool float64 `yaml:"max_cool"`
+
+	// How far above the heating temperature the cooling temperature must be.
+	Deadband float64 `yaml:"deadband"`
+
+	// The number of periods per day, at most MaxPeriods.
+	Periods int `yaml:"periods"`
+}
+
+// The capabilities of the known thermostat models, in Celsius.
+var models = map[string]Capabilities{
+	"bluelink": {
+		TimeStep: 10 * time.Minute,
+		MinHeat:  4.5,
+		MaxHeat:  32,
+		MinCool:  7,
+		MaxCool:  37,
+		Deadband: 1.5,
+		Periods:  4,
+	},
+}
+
+// Fills in the defaults of the model, converted to |u|, and validates the
+// result.
+func (c Capabilities) withDefaults(u Units) (Capabilities, error) {
+	if c.Model == "" {
+		c.Model = "bluelink"
+	}
+	m, ok := models[c.Model]
+	if !ok {
+		return c, fmt.Errorf("unknown thermostat model %q", c.Model)
+	}
+	if c.TimeStep == 0 {
+		c.TimeStep = m.TimeStep
+	}
+	for _, t := range []struct {
+		value    *float64
+		fallback float64
+	}{
+		{&c.MinHeat, u.FromCelsius(m.MinHeat)},
+		{&c.MaxHeat, u.FromCelsius(m.MaxHeat)},
+		{&c.MinCool, u.FromCelsius(m.MinCool)},
+		{&c.MaxCool, u.FromCelsius(m.MaxCool)},
+		{&c.Deadband, u.FromCelsius(m.Deadband) - u.FromCelsius(0)},
+	} {
+		if *t.value == 0 {
+			*t.value = t.fallback
+		}
+	}
+	if c.Periods == 0 {
+		c.Periods = m.Periods
+	}
+
+	if c.TimeStep < time.Minute || c.TimeStep > time.Hour {
+		return c, fmt.Errorf("time step should be between 1m and 1h, got %v", c.TimeStep)
+	}
+	if c.MinHeat > c.MaxHeat || c.MinCool > c.MaxCool {
+		return c, fmt.Errorf("min temps should be at most max temps, got heat %v-%v and cool %v-%v",
+			c.MinHeat, c.MaxHeat, c.MinCool, c.MaxCool)
+	}
+	if c.Deadband < 0 || c.MaxCool-c.MinHeat < c.Deadband {
+		return c, fmt.Errorf("deadband should be between 0 and the distance between min heat and max cool, got %v", c.Deadband)
+	}
+	if c.Periods < 1 || c.Periods > MaxPeriods {
+		return c, fmt.Errorf("periods should be between 1 and %v, got %v", MaxPeriods, c.Periods)
+	}
+	return c, nil
+}
+
+// A change made to a program to fit what the thermostat supports.
+type Adjustment struct {
+	Weekday time.Weekday
+	Period  string // e.g., "morning"
+	Field   string // One of "time", "heat" or "cool"
+	Want    string
+	Got     string
+}
+
+func (a Adjustment) String() string {
+	return fmt.Sprintf("%v %v %v: wanted %v, got %v", a.Weekday, a.Period, a.Field, a.Want, a.Got)
+}
+
+// Returns |dp|, with temperatures in |units|, fitted to |caps| and converted
+// to a thermostat set to |deviceUnits|, along with the adjustments that were
+// made. Times are rounded down to the time step, temperatures are clamped to
+// the supported ranges and rounded, and the cooling temperature is raised to
+// respect the deadband, or the heating one lowered when the cooling one is at
+// its maximum. It's an error for the program to have more periods than the
+// thermostat supports.
+func (dp DailyProgram) fit(weekday time.Weekday, units, deviceUnits Units, caps Capabilities) (DailyProgram, []Adjustment, error) {
+	var adjustments []Adjustment
+	adjust := func(period, field string, want, got interface{}) {
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			adjustments = append(adjustments, Adjustment{weekday, period, field, fmt.Sprint(want), fmt.Sprint(got)})
+		}
+	}
+	// Shows a temperature in |units|, with a single decimal.
+	show := func(temp float64) string {
+		return fmt.Sprintf("%v%v", math.Round(temp*10)/10, units.Symbol())
+	}
+	deadband := units.Convert(caps.Deadband, deviceUnits) - units.Convert(0, deviceUnits)
+	maxCool := units.Convert(caps.MaxCool, deviceUnits)
+
+	periods := 0
+	var previous *DayEvent
+	for _, p := range []struct {
+		name  string
+		event *DayEvent
+	}{{"morning", &dp.Morning}, {"day", &dp.Day}, {"evening", &dp.Evening}, {"night", &dp.Night}} {
+		e := p.event
+		t := e.Time.Truncate(caps.TimeStep)
+		adjust(p.name, "time", e.Time, t)
+
+		heat := math.Min(math.Max(e.Heat, caps.MinHeat), caps.MaxHeat)
+		cool := math.Min(math.Max(e.Cool, caps.MinCool), caps.MaxCool)
+		if cool-heat < caps.Deadband {
+			cool = math.Min(heat+caps.Deadband, caps.MaxCool)
+			heat = cool - caps.Deadband
+		}
+		heat = deviceUnits.Round(units.Convert(heat, deviceUnits))
+		cool = deviceUnits.Round(units.Convert(cool, deviceUnits))
+		// Rounding may bring the temperatures closer than the deadband. Once
+		// the cooling temperature is as high as it goes, the heating one is
+		// lowered instead.
+		for cool-heat < deadband-1e-9 {
+			if cool+deviceUnits.step() <= maxCool+1e-9 {
+				cool += deviceUnits.step()
+			} else {
+				heat -= deviceUnits.step()
+			}
+		}
+		adjust(p.name, "heat", show(e.Heat), show(deviceUnits.Convert(heat, units)))
+		adjust(p.name, "cool", show(e.Cool), show(deviceUnits.Convert(cool, units)))
+
+		*e = DayEvent{Time: t, Heat: heat, Cool: cool}
+		if previous == nil || *e != *previous {
+			periods++
+		}
+		previous = e
+	}
+	if periods > caps.Periods {
+		return dp, adjustments, fmt.Errorf("%v has %v periods, but the thermostat supports %v", weekday, periods, caps.Periods)
+	}
+	return dp, adjustments, nil
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// The names of the built-in peak strategies.
+const (
+	OffsetStrategyName   = "offset"
+	AbsoluteStrategyName = "absolute"
+	CoastStrategyName    = "coast"
+	StagedStrategyName   = "staged"
+)
+
+// The offset strategy pre-heats and sets back by offsets relative to the
+// normal program. Its configuration lives at the top of the PeakProgram.
+func validateOffsetStrategy(p PeakProgram, u Units) error {
+	if err := u.checkOffset("pre-heat temp offset", p.PreHeatTempOffset, 0, 10); err != nil {
+		return err
+	}
+	if err := u.checkOffset("peak temp offset", p.PeakTempOffset, -10, 0); err != nil {
+		return err
+	}
+	if err := u.checkOffset("pre-cool temp offset", p.PreCoolTempOffset, -10, 0); err != nil {
+		return err
+	}
+	if err := u.checkOffset("peak cool temp offset", p.PeakCoolTempOffset, 0, 10); err != nil {
+		return err
+	}
+	for _, r := range [][2]float64{{p.MinTemp, p.MaxTemp}, {p.MinCoolTemp, p.MaxCoolTemp}} {
+		for _, t := range r {
+			if err := checkOptionalTemp(u, "min and max temps", t, 0, 50); err != nil {
+				return err
+			}
+		}
+		if r[0] != 0 && r[1] != 0 && r[0] > r[1] {
+			return fmt.Errorf("min temp should be at most max temp, got %v", r)
+		}
+	}
+	return nil
+}
+
+// The absolute strategy uses fixed setpoints, regardless of the normal
+// program. A zero setpoint leaves the normal program's temperature alone.
+type AbsoluteStrategy struct {
+	// The temperature to pre-heat to, e.g., 23
+	PreHeatTemp float64 `yaml:"pre_heat_temp"`
+
+	// The temperature to heat to during the peak event, e.g., 17
+	PeakTemp float64 `yaml:"peak_temp"`
+
+	// The temperature to pre-cool to, e.g., 22
+	PreCoolTemp float64 `yaml:"pre_cool_temp"`
+
+	// The temperature to cool to during the peak event, e.g., 28
+	PeakCoolTemp float64 `yaml:"peak_cool_temp"`
+}
+
+func (s AbsoluteStrategy) validate(u Units) error {
+	for _, t := range []float64{s.PreHeatTemp, s.PeakTemp, s.PreCoolTemp, s.PeakCoolTemp} {
+		if err := checkOptionalTemp(u, "absolute temps", t, 0, 50); err != nil {
+			return err
+		}
+	}
+	if s.PeakTemp == 0 && s.PeakCoolTemp == 0 {
+		return fmt.Errorf("absolute strategy needs a peak_temp or a peak_cool_temp")
+	}
+	return nil
+}
+
+// Like Units.checkTemp, but zero is allowed since it means the temperature
+// isn't set.
+func checkOptionalTemp(u Units, what string, temp, lo, hi float64) error {
+	if temp == 0 {
+		return nil
+	}
+	return u.checkTemp(what, temp, lo, hi)
+}
+
+func (p PeakProgram) hasOffsets() bool {
+	return p.PreHeatTempOffset != 0 || p.PeakTempOffset != 0 ||
+		p.PreCoolTempOffset != 0 || p.PeakCoolTempOffset != 0
+}
+
+func (p PeakProgram) hasClamps() bool {
+	return p.MinTemp != 0 || p.MaxTemp != 0 || p.MinCoolTemp != 0 || p.MaxCoolTemp != 0
+}
+
+func (p PeakProgram) hasAbsoluteTemps() bool {
+	return p.topLevelAbsoluteTemps() != (AbsoluteStrategy{}) || p.Absolute != (AbsoluteStrategy{})
+}
+
+// Returns the names of the strategies whose block is set.
+func (p PeakProgram) strategyBlocks() []string {
+	var names []string
+	if p.Absolute != (AbsoluteStrategy{}) {
+		names = append(names, AbsoluteStrategyName)
+	}
+	if p.Coast != (CoastStrategy{}) {
+		names = append(names, CoastStrategyName)
+	}
+	if !reflect.DeepEqual(p.Staged, StagedStrategy{}) {
+		names = append(names, StagedStrategyName)
+	}
+	return names
+}
+
+func (p PeakProgram) topLevelAbsoluteTemps() AbsoluteStrategy {
+	return AbsoluteStrategy{p.PreHeatTemp, p.PeakTemp, p.PreCoolTemp, p.PeakCoolTemp}
+}
+
+// The coast strategy pre-heats, then lets the temperature drift down to the
+// minimum safe setpoint during the peak event.
+type CoastStrategy struct {
+	// How much to change the temperature by during pre-heating, relative to
+	// the normal program temperature at the start of the peak event, e.g., 2
+	PreHeatTempOffset float64 `yaml:"pre_heat_temp_offset"`
+
+	// The lowest temperature that is safe to heat to during the peak event,
+	// e.g., 15
+	MinTemp float64 `yaml:"min_temp"`
+
+	// How much to change the cooling temperature by during pre-cooling,
+	// relative to the normal program temperature at the start of the peak
+	// event, e.g., -2
+	PreCoolTempOffset float64 `yaml:"pre_cool_temp_offset"`
+
+	// The highest temperature that is safe to cool to during the peak event,
+	// e.g., 30
+	MaxCoolTemp float64 `yaml:"max_cool_temp"`
+}
+
+func (s CoastStrategy) validate(u Units) error {
+	if err := u.checkOffset("coast pre-heat temp offset", s.PreHeatTempOffset, 0, 10); err != nil {
+		return err
+	}
+	if err := u.checkTemp("coast min temp", s.MinTemp, 5, 25); err != nil {
+		return err
+	}
+	if err := u.checkOffset("coast pre-cool temp offset", s.PreCoolTempOffset, -10, 0); err != nil {
+		return err
+	}
+	return checkOptionalTemp(u, "coast max cool temp", s.MaxCoolTemp, 20, 35)
+}
+
+// The staged strategy pre-heats, then sets back further and further as the
+// peak event goes on.
+type StagedStrategy struct {
+	// How much to change the temperature by during pre-heating, relative to
+	// the normal program temperature at the start of the peak event, e.g., 2
+	PreHeatTempOffset float64 `yaml:"pre_heat_temp_offset"`
+
+	// How much to change the cooling temperature by during pre-cooling,
+	// relative to the normal program temperature at the start of the peak
+	// event, e.g., -2
+	PreCoolTempOffset float64 `yaml:"pre_cool_temp_offset"`
+
+	// The stages of the setback, in order. The first one must start with the
+	// peak event.
+	Steps []StagedStep `yaml:"steps"`
+}
+
+// A single stage of the staged strategy.
+type StagedStep struct {
+	// How long after the start of the peak event the stage starts, e.g., "1h"
+	After time.Duration `yaml:"after"`
+
+	// How much to change the temperature during the stage, relative to the
+	// normal program temperature at the start of the peak event, e.g., -1
+	TempOffset float64 `yaml:"temp_offset"`
+
+	// How much to change the cooling temperature during the stage, relative
+	// to the normal program temperature at the start of the peak event,
+	// e.g., 1
+	CoolTempOffset float64 `yaml:"cool_temp_offset"`
+}
+
+func (s StagedStrategy) validate(u Units) error {
+	if err := u.checkOffset("staged pre-heat temp offset", s.PreHeatTempOffset, 0, 10); err != nil {
+		return err
+	}
+	if err := u.checkOffset("staged pre-cool temp offset", s.PreCoolTempOffset, -10, 0); err != nil {
+		return err
+	}
+	if len(s.Steps) < 1 || s.Steps[0].After != 0 {
+		return fmt.Errorf("staged strategy needs a first step that starts at 0s")
+	}
+	last := -1 * time.Second
+	for _, step := range s.Steps {
+		if step.After <= last {
+			return fmt.Errorf("staged steps aren't in order, %v !< %v", last, step.After)
+		}
+		last = step.After
+		if err := u.checkOffset("staged temp offset", step.TempOffset, -10, 0); err != nil {
+			return err
+		}
+		if err := u.checkOffset("staged cool temp offset", step.CoolTempOffset, 0, 10); err != nil {
+			return err
+		}
+	}
+	return nil
+}
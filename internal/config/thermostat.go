@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"thermostat-scheduler/internal/api"
+)
+
+// A thermostat to program, matched by UUID or name, along with its programs.
+type Thermostat struct {
+	// The device identifier, e.g., "0c1d2e3f-...". Takes precedence over the
+	// name when both are set.
+	UUID string `yaml:"uuid"`
+
+	// The name of the device, as set in the BlueLink app, e.g., "Upstairs".
+	Name string `yaml:"name"`
+
+	// The normal every day program of this thermostat.
+	NormalProgram WeeklyProgram `yaml:"normal_program"`
+
+	// How to modify the program of this thermostat during peak events.
+	PeakProgram PeakProgram `yaml:"peak_program"`
+
+	// The scale this thermostat is set to. Defaults to the top-level
+	// device_units.
+	DeviceUnits Units `yaml:"device_units"`
+
+	// What this thermostat supports. Defaults to the top-level device.
+	Device Capabilities `yaml:"device"`
+}
+
+// Returns whether |d| is this thermostat. A thermostat with neither a UUID
+// nor a name matches any device.
+func (t Thermostat) Matches(d api.Device) bool {
+	if t.UUID != "" {
+		return t.UUID == d.UUID
+	}
+	if t.Name != "" {
+		return t.Name == d.Name
+	}
+	return true
+}
+
+func (t Thermostat) String() string {
+	switch {
+	case t.Name != "":
+		return t.Name
+	case t.UUID != "":
+		return t.UUID
+	}
+	return "thermostat"
+}
+
+// Returns the config to use for |t|, with its programs and device in place
+// of the top-level ones.
+func (c Config) ForThermostat(t Thermostat) Config {
+	c.NormalProgram = t.NormalProgram
+	c.PeakProgram = t.PeakProgram
+	c.DeviceUnits = t.DeviceUnits
+	c.Device = t.Device
+	c.Thermostats = []Thermostat{t}
+	return c
+}
+
+// Validates the thermostats of |c|. When none are declared, a single one
+// that matches any device is made from the top-level programs.
+func validateThermostats(c Config) ([]Thermostat, error) {
+	if len(c.Thermostats) == 0 {
+		t := Thermostat{
+			NormalProgram: c.NormalProgram,
+			PeakProgram:   c.PeakProgram,
+			DeviceUnits:   c.DeviceUnits,
+			Device:        c.Device,
+		}
+		t, err := validateThermostat(t, c.Units)
+		return []Thermostat{t}, err
+	}
+
+	if c.NormalProgram != (WeeklyProgram{}) {
+		return nil, errors.New("normal_program should be set on each thermostat when thermostats are declared")
+	}
+	if !reflect.DeepEqual(c.PeakProgram, PeakProgram{}) {
+		return nil, errors.New("peak_program should be set on each thermostat when thermostats are declared")
+	}
+	seen := make(map[string]bool)
+	var thermostats []Thermostat
+	for _, t := range c.Thermostats {
+		if t.UUID == "" && t.Name == "" {
+			return nil, errors.New("thermostats should have a uuid or a name")
+		}
+		if seen[t.UUID+"/"+t.Name] {
+			return nil, fmt.Errorf("thermostat %v is declared more than once", t)
+		}
+		seen[t.UUID+"/"+t.Name] = true
+
+		if t.DeviceUnits == "" {
+			t.DeviceUnits = c.DeviceUnits
+		}
+		if t.Device == (Capabilities{}) {
+			t.Device = c.Device
+		}
+		t, err := validateThermostat(t, c.Units)
+		if err != nil {
+			return nil, fmt.Errorf("thermostat %v: %w", t, err)
+		}
+		thermostats = append(thermostats, t)
+	}
+	return thermostats, nil
+}
+
+// Validates the programs and device of |t|, filling in the device's defaults.
+func validateThermostat(t Thermostat, u Units) (Thermostat, error) {
+	if t.DeviceUnits != Celsius && t.DeviceUnits != Fahrenheit {
+		return t, fmt.Errorf("device units should be celsius or fahrenheit, got %q", t.DeviceUnits)
+	}
+	device, err := t.Device.withDefaults(u)
+	if err != nil {
+		return t, fmt.Errorf("invalid device: %w", err)
+	}
+	t.Device = device
+	err = validateWeeklyProgram(t.NormalProgram, u)
+	if err != nil {
+		return t, fmt.Errorf("invalid weekly program: %w", err)
+	}
+	// Otherwise, every run would fail to convert it for the thermostat.
+	if _, _, err := t.NormalProgram.ToStateData(u, t.DeviceUnits, t.Device); err != nil {
+		return t, fmt.Errorf("weekly program doesn't fit the thermostat: %w", err)
+	}
+	t.PeakProgram, err = validatePeakProgram(t.PeakProgram, u)
+	if err != nil {
+		return t, fmt.Errorf("invalid peak program: %w", err)
+	}
+	return t, nil
+}
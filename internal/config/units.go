@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"math"
+)
+
+// The scale temperatures are expressed in, either in the config or on the
+// thermostat. The zero value is Celsius.
+type Units string
+
+const (
+	Celsius    Units = "celsius"
+	Fahrenheit Units = "fahrenheit"
+)
+
+func (u Units) isFahrenheit() bool {
+	return u == Fahrenheit
+}
+
+// Returns the symbol of the scale, e.g., "F".
+func (u Units) Symbol() string {
+	if u.isFahrenheit() {
+		return "F"
+	}
+	return "C"
+}
+
+// Converts |temp| from Celsius to this scale.
+func (u Units) FromCelsius(temp float64) float64 {
+	if u.isFahrenheit() {
+		return temp*9/5 + 32
+	}
+	return temp
+}
+
+// Converts |temp| from this scale to Celsius.
+func (u Units) ToCelsius(temp float64) float64 {
+	if u.isFahrenheit() {
+		return (temp - 32) * 5 / 9
+	}
+	return temp
+}
+
+// Converts |temp| from this scale to |to|.
+func (u Units) Convert(temp float64, to Units) float64 {
+	if u.isFahrenheit() == to.isFahrenheit() {
+		return temp
+	}
+	return to.FromCelsius(u.ToCelsius(temp))
+}
+
+// Rounds |temp| to the nearest temperature a thermostat using this scale
+// supports: half degrees in Celsius, and whole degrees in Fahrenheit.
+func (u Units) Round(temp float64) float64 {
+	return math.Round(temp/u.step()) * u.step()
+}
+
+// Returns the smallest temperature change a thermostat using this scale
+// supports.
+func (u Units) step() float64 {
+	if u.isFahrenheit() {
+		return 1
+	}
+	return 0.5
+}
+
+// Returns an error if |temp| isn't between |lo| and |hi| Celsius, once
+// converted to this scale.
+func (u Units) checkTemp(what string, temp, lo, hi float64) error {
+	lo, hi = u.FromCelsius(lo), u.FromCelsius(hi)
+	if temp < lo || temp > hi {
+		return fmt.Errorf("%v should be between %v%v and %v%v, got %v", what, lo, u.Symbol(), hi, u.Symbol(), temp)
+	}
+	return nil
+}
+
+// Returns an error if |offset| isn't between |lo| and |hi| degrees Celsius,
+// once converted to this scale.
+func (u Units) checkOffset(what string, offset, lo, hi float64) error {
+	if u.isFahrenheit() {
+		lo, hi = lo*9/5, hi*9/5
+	}
+	if offset < lo || offset > hi {
+		return fmt.Errorf("%v should be between %v%v and %v%v, got %v", what, lo, u.Symbol(), hi, u.Symbol(), offset)
+	}
+	return nil
+}
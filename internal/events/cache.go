@@ -2,6 +2,8 @@ package events
 
 import (
 	"bufio"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,6 +29,7 @@ func NewCache() (*Cache, error) {
 type store interface {
 	Load() (map[string]struct{}, error)
 	Save(id string) error
+	Remove(id string) error
 }
 
 type fileStore struct {
@@ -65,9 +68,228 @@ func (s *fileStore) Save(id string) error {
 	return err
 }
 
+// Removes |id|, rewriting the file at once so that it's never left with part
+// of the others.
+func (s *fileStore) Remove(id string) error {
+	ids, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if _, ok := ids[id]; !ok {
+		return nil
+	}
+	delete(ids, id)
+
+	var b strings.Builder
+	for other := range ids {
+		b.WriteString(other + "\n")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// The events to leave out of the programs, e.g., when there are guests, kept
+// next to the seen ones.
+type SkipList struct {
+	store store
+}
+
+func NewSkipList() (*SkipList, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &SkipList{
+		store: &fileStore{
+			path: filepath.Join(cacheDir, "thermostat-scheduler", "skipped_events"),
+		},
+	}, nil
+}
+
+// How long after it starts a skipped event is kept, once it's surely over.
+const skipRetention = 24 * time.Hour
+
+// Leaves the event that starts at |start| out of the programs from now on.
+// The event is only known by its start, so that it can be skipped without
+// fetching the events.
+func (l *SkipList) Skip(start time.Time) error {
+	skipped, err := l.store.Load()
+	if err != nil {
+		return err
+	}
+	if _, ok := skipped[skipID(start)]; ok {
+		return nil
+	}
+	return l.store.Save(skipID(start))
+}
+
+// Plans for the event that starts at |start| again.
+func (l *SkipList) Unskip(start time.Time) error {
+	return l.store.Remove(skipID(start))
+}
+
+// Returns |peakEvents| with the skipped ones marked as such, forgetting the
+// skipped events that started long before |now|.
+func (l *SkipList) mark(peakEvents []PeakEvent, now time.Time) ([]PeakEvent, error) {
+	skipped, err := l.store.Load()
+	if err != nil {
+		return peakEvents, err
+	}
+	for id := range skipped {
+		start, err := time.Parse(time.RFC3339, id)
+		if err != nil {
+			return peakEvents, fmt.Errorf("invalid skipped event %q", id)
+		}
+		if start.Before(now.Add(-skipRetention)) {
+			if err := l.store.Remove(id); err != nil {
+				return peakEvents, err
+			}
+		}
+	}
+	for i := range peakEvents {
+		_, peakEvents[i].Skipped = skipped[skipID(peakEvents[i].Start)]
+	}
+	return peakEvents, nil
+}
+
+// Returns |start| as it's kept, the same for any time zone.
+func skipID(start time.Time) string {
+	return start.UTC().Format(time.RFC3339)
+}
+
+// The peak events added by hand, e.g., to try the whole flow or to respond to
+// a signal other than Hydro-Quebec's, kept next to the seen ones.
+type ForcedEvents struct {
+	store store
+}
+
+func NewForcedEvents() (*ForcedEvents, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &ForcedEvents{
+		store: &fileStore{
+			path: filepath.Join(cacheDir, "thermostat-scheduler", "forced_events"),
+		},
+	}, nil
+}
+
+// Adds a peak event from |start| to |end|, and returns it.
+func (f *ForcedEvents) Add(start, end time.Time) (PeakEvent, error) {
+	event := PeakEvent{Start: start, End: end, Forced: true}
+	forced, err := f.store.Load()
+	if err != nil {
+		return event, err
+	}
+	if _, ok := forced[forcedID(event)]; ok {
+		return event, nil
+	}
+	return event, f.store.Save(forcedID(event))
+}
+
+// Returns the forced events, forgetting the ones that ended before |now|.
+func (f *ForcedEvents) load(now time.Time) ([]PeakEvent, error) {
+	forced, err := f.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	var peakEvents []PeakEvent
+	for id := range forced {
+		var start, end time.Time
+		fields := strings.Fields(id)
+		if len(fields) == 2 {
+			start, err = time.Parse(time.RFC3339, fields[0])
+			if err == nil {
+				end, err = time.Parse(time.RFC3339, fields[1])
+			}
+		}
+		if len(fields) != 2 || err != nil {
+			return nil, fmt.Errorf("invalid forced event %q", id)
+		}
+		if end.Before(now) {
+			if err := f.store.Remove(id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		peakEvents = append(peakEvents, PeakEvent{Start: start, End: end, Forced: true})
+	}
+	return peakEvents, nil
+}
+
+// Returns the start and end of |event|, as they're kept.
+func forcedID(event PeakEvent) string {
+	return event.Start.Format(time.RFC3339) + " " + event.End.Format(time.RFC3339)
+}
+
 type PeakEvent struct {
 	Start time.Time
 	End   time.Time
+	Offer string // The offer the event is for, e.g., CPC-D
+
+	// Whether the event was skipped, and is left out of the programs.
+	Skipped bool
+
+	// Whether the event was added by hand rather than announced.
+	Forced bool
+}
+
+// Returns how the event is referred to, e.g., to skip it: its start, in local
+// time, e.g., "2024-01-15T06:00".
+func (e PeakEvent) ID() string {
+	return e.Start.Local().Format("2006-01-02T15:04")
+}
+
+// The error for an event that isn't among the peak events.
+type EventNotFoundError struct {
+	ID string
+}
+
+func (e *EventNotFoundError) Error() string {
+	return fmt.Sprintf("no peak event starts at %v, expected its start as, e.g., 2024-01-15T06:00", e.ID)
+}
+
+// Returns the event of |peakEvents| whose ID is |id|.
+func FindEvent(peakEvents []PeakEvent, id string) (PeakEvent, error) {
+	for _, e := range peakEvents {
+		if e.ID() == id {
+			return e, nil
+		}
+	}
+	return PeakEvent{}, &EventNotFoundError{id}
+}
+
+// Logs the event as its start, end and offer, and whether it was skipped or
+// forced.
+func (e PeakEvent) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Time("start", e.Start),
+		slog.Time("end", e.End),
+		slog.String("offer", e.Offer),
+	}
+	if e.Skipped {
+		attrs = append(attrs, slog.Bool("skipped", true))
+	}
+	if e.Forced {
+		attrs = append(attrs, slog.Bool("forced", true))
+	}
+	return slog.GroupValue(attrs...)
 }
 
 func eventID(event PeakEvent) string {
@@ -1,6 +1,7 @@
 package events
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -18,6 +19,11 @@ func (s *inMemoryStore) Save(id string) error {
 	return nil
 }
 
+func (s *inMemoryStore) Remove(id string) error {
+	delete(s.events, id)
+	return nil
+}
+
 func NewInMemoryCache() *Cache {
 	return &Cache{
 		store: &inMemoryStore{
@@ -60,3 +66,78 @@ func TestEventCache(t *testing.T) {
 		t.Errorf("event not found in cache")
 	}
 }
+
+func TestSkipList(t *testing.T) {
+	skipList := &SkipList{
+		store: &fileStore{path: filepath.Join(t.TempDir(), "skipped_events")},
+	}
+	start := time.Date(2024, time.January, 15, 6, 0, 0, 0, time.Local)
+	morning := PeakEvent{Start: start, End: start.Add(3 * time.Hour)}
+	evening := PeakEvent{Start: start.Add(10 * time.Hour), End: start.Add(14 * time.Hour)}
+
+	// Skipping twice is the same as skipping once.
+	for i := 0; i < 2; i++ {
+		if err := skipList.Skip(morning.Start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := skipList.Skip(evening.Start); err != nil {
+		t.Fatal(err)
+	}
+	if err := skipList.Unskip(evening.Start); err != nil {
+		t.Fatal(err)
+	}
+
+	// The event is skipped whatever time zone it's announced in.
+	announced := morning
+	announced.Start = morning.Start.In(time.FixedZone("EST", -5*60*60))
+	marked, err := skipList.mark([]PeakEvent{announced, evening}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !marked[0].Skipped || marked[1].Skipped {
+		t.Errorf("expected only the morning event to be skipped, got %+v", marked)
+	}
+
+	// It's forgotten once it's long over.
+	if _, err := skipList.mark(nil, start.Add(skipRetention+time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if skipped, _ := skipList.store.Load(); len(skipped) != 0 {
+		t.Errorf("expected the skipped event to be forgotten, got %v", skipped)
+	}
+
+	if found, err := FindEvent(marked, "2024-01-15T16:00"); err != nil || !found.Start.Equal(evening.Start) {
+		t.Errorf("expected to find the evening event, got %+v, %v", found, err)
+	}
+	if _, err := FindEvent(marked, "2024-01-16T06:00"); err == nil {
+		t.Errorf("expected no event to start at 2024-01-16T06:00")
+	}
+}
+
+func TestForcedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forced_events")
+	forcedEvents := &ForcedEvents{store: &fileStore{path: path}}
+	now := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.Local)
+
+	// Adding twice is the same as adding once.
+	for i := 0; i < 2; i++ {
+		if _, err := forcedEvents.Add(now.Add(4*time.Hour), now.Add(8*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := forcedEvents.Add(now.Add(-4*time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The event that is over is forgotten.
+	for i := 0; i < 2; i++ {
+		forced, err := forcedEvents.load(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(forced) != 1 || !forced[0].Forced || forced[0].ID() != "2024-01-15T16:00" || !forced[0].End.Equal(now.Add(8*time.Hour)) {
+			t.Errorf("expected the upcoming event, got %+v", forced)
+		}
+	}
+}
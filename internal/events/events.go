@@ -1,19 +1,35 @@
 package events
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"thermostat-scheduler/internal/retry"
 	"time"
 )
 
-func GetPeakEvents(url string, verbose bool) ([]PeakEvent, error) {
-	offers, err := fetchWinterPeakOffers(url)
-	if err != nil {
-		return []PeakEvent{}, fmt.Errorf("failed to get winter peak info: %w", err)
-	}
+// The official JSON of Hydro-Quebec's winter peak events.
+const DefaultURL = "https://donnees.solutions.hydroquebec.com/donnees-ouvertes/data/json/pointeshivernales.json"
+
+// Returns the peak events at |url| along with the forced ones, with the
+// skipped ones marked as such, logging the ones that are announced for the
+// first time to |logger|. When the events at |url| can't be fetched, the ones
+// last fetched from it are returned instead, along with the forced ones and
+// the error.
+func GetPeakEvents(url string, policy retry.Policy, logger *slog.Logger) ([]PeakEvent, error) {
+	return GetPeakEventsContext(context.Background(), url, policy, true, logger)
+}
+
+// Like GetPeakEvents, but stops when |ctx| is done. Unless |markSeen|, e.g.,
+// to try the config, the events are logged without being marked as seen, so
+// they are still announced on the next run.
+func GetPeakEventsContext(ctx context.Context, url string, policy retry.Policy, markSeen bool, logger *slog.Logger) ([]PeakEvent, error) {
+	announced, fetchErr := announcedEvents(ctx, url, policy, logger)
 
 	cache, err := NewCache()
 	if err != nil {
@@ -25,20 +41,107 @@ func GetPeakEvents(url string, verbose bool) ([]PeakEvent, error) {
 		return []PeakEvent{}, fmt.Errorf("failed to load seen events: %w", err)
 	}
 
-	events := convertToPeakEvents(offers)
+	events := announced
+	forcedEvents, err := NewForcedEvents()
+	if err != nil {
+		return []PeakEvent{}, fmt.Errorf("failed to create forced events: %w", err)
+	}
+	forced, err := forcedEvents.load(time.Now())
+	if err != nil {
+		return []PeakEvent{}, fmt.Errorf("failed to load forced events: %w", err)
+	}
+	events = append(events, forced...)
+	skipList, err := NewSkipList()
+	if err != nil {
+		return []PeakEvent{}, fmt.Errorf("failed to create skip list: %w", err)
+	}
+	if events, err = skipList.mark(events, time.Now()); err != nil {
+		return []PeakEvent{}, fmt.Errorf("failed to load skipped events: %w", err)
+	}
 	for _, event := range events {
 		if event.Start.After(time.Now()) {
 			if _, seen := seenEvents[eventID(event)]; !seen {
-				log.Println("upcoming peak event:", event)
+				logger.Info("Upcoming peak event", "event", event)
+				if !markSeen {
+					continue
+				}
 				if err := cache.markEventAsSeen(event); err != nil {
-					log.Printf("failed to mark event as seen: %v", err)
+					logger.Warn("Failed to mark event as seen", "event", event, "err", err)
 				}
 			}
 		}
 	}
+	if fetchErr != nil {
+		return events, fetchErr
+	}
 	return events, nil
 }
 
+// Returns the events announced at |url|, keeping them in the user's cache
+// directory. When they can't be fetched, the ones last kept for |url| are
+// returned along with the error, or none if there are none.
+func announcedEvents(ctx context.Context, url string, policy retry.Policy, logger *slog.Logger) ([]PeakEvent, error) {
+	path, pathErr := announcedPath()
+	offers, err := fetchWinterPeakOffers(ctx, url, policy)
+	if err != nil {
+		err = fmt.Errorf("failed to get winter peak info: %w", err)
+		if pathErr == nil {
+			offers = loadAnnouncedOffers(path, url, logger)
+		}
+		return convertToPeakEvents(offers, logger), err
+	}
+	if pathErr == nil {
+		if err := saveAnnouncedOffers(path, url, offers); err != nil {
+			logger.Warn("Failed to keep the announced events", "path", path, "err", err)
+		}
+	}
+	return convertToPeakEvents(offers, logger), nil
+}
+
+// The announced events, as they're kept.
+type announced struct {
+	URL    string            `json:"url"`
+	Offers []WinterPeakOffer `json:"offers"`
+}
+
+func announcedPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "thermostat-scheduler", "announced_events.json"), nil
+}
+
+func loadAnnouncedOffers(path, url string, logger *slog.Logger) []WinterPeakOffer {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var a announced
+	if err == nil {
+		err = json.Unmarshal(data, &a)
+	}
+	if err != nil {
+		logger.Warn("Failed to read the announced events that were kept", "path", path, "err", err)
+		return nil
+	}
+	if a.URL != url {
+		return nil
+	}
+	return a.Offers
+}
+
+func saveAnnouncedOffers(path, url string, offers []WinterPeakOffer) error {
+	data, err := json.Marshal(announced{url, offers})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
 type WinterPeakOffer struct {
 	Offer    string    `json:"offre"`         // Offers in effect during the event
 	Start    time.Time `json:"datedebut"`     // Start of the peak demand event
@@ -48,38 +151,65 @@ type WinterPeakOffer struct {
 	Sector   string    `json:"secteurclient"` // Résidentiel or Affaires
 }
 
-func convertToPeakEvents(offers []WinterPeakOffer) []PeakEvent {
+func convertToPeakEvents(offers []WinterPeakOffer, logger *slog.Logger) []PeakEvent {
 	var events []PeakEvent
 	for _, e := range offers {
 		if e.Start.After(e.End) {
-			log.Println("Skipping invalid event:", e)
+			logger.Warn("Skipping invalid event", "offer", e.Offer, "start", e.Start, "end", e.End)
 		}
 		events = append(events, PeakEvent{
 			Start: e.Start,
 			End:   e.End,
+			Offer: e.Offer,
 		})
 	}
 	return events
 }
 
-func fetchWinterPeakOffers(url string) ([]WinterPeakOffer, error) {
-	var offers []WinterPeakOffer
+// Fetches the offers at |url|, retrying transient failures following
+// |policy|.
+func fetchWinterPeakOffers(ctx context.Context, url string, policy retry.Policy) ([]WinterPeakOffer, error) {
+	var data []byte
+	err := policy.DoContext(ctx, func() error {
+		var err error
+		data, err = fetch(ctx, url)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseWinterPeakOffers(data)
+}
+
+// How long a single request for the offers can take.
+const fetchTimeout = 30 * time.Second
 
-	resp, err := http.Get(url)
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return offers, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, retry.Retryable(fmt.Errorf("HTTP request failed: %w", err), 0)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return offers, fmt.Errorf("HTTP request failed with: %s", resp.Status)
+		err := fmt.Errorf("HTTP request failed with: %s", resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return nil, retry.Retryable(err, retry.After(resp.Header))
+		}
+		return nil, err
 	}
 
 	bytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return offers, fmt.Errorf("failed to read HTTP response: %w", err)
+		return nil, retry.Retryable(fmt.Errorf("failed to read HTTP response: %w", err), 0)
 	}
-	return parseWinterPeakOffers(bytes)
+	return bytes, nil
 }
 
 func parseWinterPeakOffers(data []byte) ([]WinterPeakOffer, error) {
@@ -2,14 +2,18 @@
 package events
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"thermostat-scheduler/internal/retry"
 	"time"
 )
 
 func TestGetPeakEvents(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, `[
 			{
@@ -24,7 +28,7 @@ func TestGetPeakEvents(t *testing.T) {
 	}))
 	defer server.Close()
 
-	events, err := GetPeakEvents(server.URL, false)
+	events, err := GetPeakEvents(server.URL, retry.Policy{}, slog.Default())
 	if err != nil {
 		t.Fatalf("GetPeakEvents failed: %v", err)
 	}
@@ -38,3 +42,84 @@ func TestGetPeakEvents(t *testing.T) {
 		t.Errorf("expected start time %v, got %v", expectedStart, events[0].Start)
 	}
 }
+
+func TestFetchWinterPeakOffersRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `[]`)
+	}))
+	defer server.Close()
+
+	// Without retries, the transient failure is returned.
+	if _, err := fetchWinterPeakOffers(context.Background(), server.URL, retry.Policy{}); err == nil {
+		t.Errorf("expected an error without retries")
+	}
+
+	requests = 0
+	policy := retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	if _, err := fetchWinterPeakOffers(context.Background(), server.URL, policy); err != nil || requests != 2 {
+		t.Errorf("expected success on the second request, got %v requests and %v", requests, err)
+	}
+}
+
+func TestGetPeakEventsWhenDown(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day()+1, 6, 0, 0, 0, now.Location())
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `[{"datedebut": %q, "datefin": %q, "offre": "CPC-D"}]`,
+			start.Format(time.RFC3339), start.Add(3*time.Hour).Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	// Without any events fetched before, nor forced ones, there are none.
+	down = true
+	if events, err := GetPeakEvents(server.URL, retry.Policy{}, slog.Default()); err == nil || len(events) != 0 {
+		t.Errorf("expected an error without events, got %v, %v", events, err)
+	}
+
+	down = false
+	if _, err := GetPeakEvents(server.URL, retry.Policy{}, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	forcedEvents, err := NewForcedEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forcedEvents.Add(start.Add(10*time.Hour), start.Add(12*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	skipList, err := NewSkipList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := skipList.Skip(start.Add(10 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once down, the events fetched before are returned along with the forced
+	// and skipped ones, and the error.
+	down = true
+	events, err := GetPeakEvents(server.URL, retry.Policy{}, slog.Default())
+	if err == nil {
+		t.Errorf("expected the error")
+	}
+	if len(events) != 2 || events[0].Forced || !events[0].Start.Equal(start) || !events[1].Forced || !events[1].Skipped {
+		t.Errorf("expected the event fetched before and the forced one, got %+v", events)
+	}
+
+	// Those of another URL aren't.
+	if events, _ := GetPeakEvents(server.URL+"/other", retry.Policy{}, slog.Default()); len(events) != 1 || !events[0].Forced {
+		t.Errorf("expected only the forced event, got %+v", events)
+	}
+}
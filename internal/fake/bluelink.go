@@ -0,0 +1,284 @@
+// Package fake provides a fake of the BlueLink API, with stateful devices and
+// injectable failures, for tests and for trying the scheduler without a
+// thermostat.
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"thermostat-scheduler/internal/api"
+	"thermostat-scheduler/internal/config"
+)
+
+// The endpoints of the fake, to inject failures into and count calls to.
+const (
+	LoginEndpoint        = "login"
+	DevicesEndpoint      = "devices"
+	SetStateAttrEndpoint = "setstateattr"
+)
+
+// A failure to return instead of handling a request.
+type Failure struct {
+	Endpoint string // One of the endpoints above, or empty for any of them.
+	Status   int    // e.g., http.StatusServiceUnavailable
+	Body     string // e.g., `{"detail": "Device is offline."}`
+	Header   http.Header
+}
+
+// A fake of the BlueLink API. It serves the API at its root, so its base URL
+// is the URL of the server it's mounted on, followed by a slash.
+type BlueLink struct {
+	mu       sync.Mutex
+	username string
+	password string
+	devices  []*api.Device
+	offline  map[string]bool
+	dropped  map[string]int
+	tokens   map[string]bool
+	failures []Failure
+	calls    map[string]int
+}
+
+// Returns a fake that accepts |username| and |password|, or any credentials
+// when |username| is empty, and that has |devices|.
+func NewBlueLink(username, password string, devices ...api.Device) *BlueLink {
+	b := &BlueLink{
+		username: username,
+		password: password,
+		offline:  make(map[string]bool),
+		dropped:  make(map[string]int),
+		tokens:   make(map[string]bool),
+		calls:    make(map[string]int),
+	}
+	for _, d := range devices {
+		d := d
+		b.devices = append(b.devices, &d)
+	}
+	return b
+}
+
+// Adds |d| to the devices.
+func (b *BlueLink) AddDevice(d api.Device) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.devices = append(b.devices, &d)
+}
+
+// Returns the current state of the device with |uuid|.
+func (b *BlueLink) Device(uuid string) (api.Device, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := b.device(uuid); d != nil {
+		return *d, true
+	}
+	return api.Device{}, false
+}
+
+// Sets whether the device with |uuid| is offline, which makes updating it
+// fail.
+func (b *BlueLink) SetOffline(uuid string, offline bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offline[uuid] = offline
+}
+
+// Makes the device with |uuid| ignore the next |times| updates, which still
+// succeed, as when the thermostat doesn't sync with the API.
+func (b *BlueLink) DropWrites(uuid string, times int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropped[uuid] += times
+}
+
+// Makes the next |times| requests to the endpoint of |f| fail with |f|.
+// Failures are returned in the order they're added.
+func (b *BlueLink) Fail(f Failure, times int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < times; i++ {
+		b.failures = append(b.failures, f)
+	}
+}
+
+// Invalidates the tokens handed out so far, as when a session expires.
+func (b *BlueLink) ExpireTokens() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = make(map[string]bool)
+}
+
+// Returns the number of requests made to |endpoint|, including failed ones.
+func (b *BlueLink) Calls(endpoint string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[endpoint]
+}
+
+func (b *BlueLink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	var endpoint string
+	switch {
+	case path == "rest-auth/login" && r.Method == http.MethodPost:
+		endpoint = LoginEndpoint
+	case path == "devices" && r.Method == http.MethodGet:
+		endpoint = DevicesEndpoint
+	case len(parts) == 3 && parts[0] == "manage" && parts[2] == "setstateattr" && r.Method == http.MethodPost:
+		endpoint = SetStateAttrEndpoint
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+		return
+	}
+	b.calls[endpoint]++
+
+	for i, f := range b.failures {
+		if f.Endpoint == "" || f.Endpoint == endpoint {
+			b.failures = append(b.failures[:i], b.failures[i+1:]...)
+			for k, v := range f.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(f.Status)
+			w.Write([]byte(f.Body))
+			return
+		}
+	}
+
+	if endpoint == LoginEndpoint {
+		b.login(w, r)
+		return
+	}
+	if !b.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")] {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"detail": "Invalid token."})
+		return
+	}
+	if endpoint == DevicesEndpoint {
+		devices := []api.Device{}
+		for _, d := range b.devices {
+			devices = append(devices, *d)
+		}
+		writeJSON(w, http.StatusOK, devices)
+		return
+	}
+	b.setStateAttr(w, r, parts[1])
+}
+
+func (b *BlueLink) login(w http.ResponseWriter, r *http.Request) {
+	var details api.LoginDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+		return
+	}
+	if b.username != "" && (details.Username != b.username || details.Password != b.password) {
+		writeJSON(w, http.StatusBadRequest, map[string][]string{
+			"non_field_errors": {"Unable to log in with provided credentials."},
+		})
+		return
+	}
+	key := make([]byte, 20)
+	rand.Read(key)
+	token := hex.EncodeToString(key)
+	b.tokens[token] = true
+	writeJSON(w, http.StatusOK, api.AuthenticationKey{Key: token})
+}
+
+// Updates the programs that are set in the request, like the API does.
+func (b *BlueLink) setStateAttr(w http.ResponseWriter, r *http.Request, uuid string) {
+	d := b.device(uuid)
+	if d == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+		return
+	}
+	if b.offline[uuid] {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "Device is offline."})
+		return
+	}
+	var data api.StateData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+		return
+	}
+	programs := []struct{ from, to *string }{
+		{&data.Program1, &d.StateData.Program1},
+		{&data.Program2, &d.StateData.Program2},
+		{&data.Program3, &d.StateData.Program3},
+		{&data.Program4, &d.StateData.Program4},
+		{&data.Program5, &d.StateData.Program5},
+		{&data.Program6, &d.StateData.Program6},
+		{&data.Program7, &d.StateData.Program7},
+	}
+	// Reject the whole update if any program is invalid.
+	for _, p := range programs {
+		if *p.from != "" && !validProgram(*p.from) {
+			writeJSON(w, http.StatusBadRequest, map[string][]string{"PGM": {"Invalid program."}})
+			return
+		}
+	}
+	if b.dropped[uuid] > 0 {
+		b.dropped[uuid]--
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+	for _, p := range programs {
+		if *p.from != "" {
+			*p.to = *p.from
+		}
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// Returns whether |program| has the eight 7-digit parts of a daily program.
+func validProgram(program string) bool {
+	if len(program) != 56 {
+		return false
+	}
+	for _, c := range program {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BlueLink) device(uuid string) *api.Device {
+	for _, d := range b.devices {
+		if d.UUID == uuid {
+			return d
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Returns a fake with a device for each thermostat of |cfg|, which accepts
+// the credentials of |cfg|. The devices start with their normal program.
+func NewBlueLinkFor(cfg config.Config) (*BlueLink, error) {
+	var devices []api.Device
+	for i, t := range cfg.Thermostats {
+		sd, _, err := t.NormalProgram.ToStateData(cfg.Units, t.DeviceUnits, t.Device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the normal program of %v: %w", t, err)
+		}
+		d := api.Device{UUID: t.UUID, Name: t.Name, StateData: sd}
+		if d.UUID == "" {
+			d.UUID = fmt.Sprintf("fake-%v", i+1)
+		}
+		if d.Name == "" {
+			d.Name = fmt.Sprintf("Fake thermostat %v", i+1)
+		}
+		devices = append(devices, d)
+	}
+	return NewBlueLink(cfg.Username, cfg.Password, devices...), nil
+}
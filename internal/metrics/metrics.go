@@ -0,0 +1,187 @@
+// Package metrics keeps gauges and counters, and writes them in the
+// Prometheus text exposition format, either to serve them on /metrics or to
+// leave them in a file for the node_exporter textfile collector.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The metrics of a program, written in the order they were created.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type family struct {
+	name, help, kind string
+	labelNames       []string
+	values           map[string]*sample // Keyed by the label values.
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// A value that goes up and down, with one value per combination of label
+// values.
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// A value that only goes up, with one value per combination of label values.
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// Returns a new gauge called |name|, with a value for each combination of
+// values of |labelNames|.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r, r.newFamily(name, help, "gauge", labelNames)}
+}
+
+// Returns a new counter called |name|, with a value for each combination of
+// values of |labelNames|.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r, r.newFamily(name, help, "counter", labelNames)}
+}
+
+func (r *Registry) newFamily(name, help, kind string, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := &family{name: name, help: help, kind: kind, labelNames: labelNames, values: make(map[string]*sample)}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Sets the value for |labelValues|, given in the order of the label names.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.sample(labelValues).value = value
+}
+
+// Removes all the values, e.g., before setting the ones that still apply.
+func (g *Gauge) Reset() {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.values = make(map[string]*sample)
+}
+
+// Adds one to the value for |labelValues|.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Adds |delta|, which can't be negative, to the value for |labelValues|.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.sample(labelValues).value += delta
+}
+
+func (f *family) sample(labelValues []string) *sample {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %v expects %v label values, got %v", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.values[key]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		f.values[key] = s
+	}
+	return s
+}
+
+// Writes the metrics to |w| in the Prometheus text exposition format. The
+// metrics without any value are left out.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, f := range r.families {
+		if len(f.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %v %v\n", f.name, escape(f.help, false))
+		fmt.Fprintf(&b, "# TYPE %v %v\n", f.name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.values[k]
+			b.WriteString(f.name)
+			if len(f.labelNames) > 0 {
+				b.WriteString("{")
+				for i, name := range f.labelNames {
+					if i > 0 {
+						b.WriteString(",")
+					}
+					fmt.Fprintf(&b, "%v=\"%v\"", name, escape(s.labelValues[i], true))
+				}
+				b.WriteString("}")
+			}
+			fmt.Fprintf(&b, " %v\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Escapes |s| for a help text or, when |quoted|, a label value.
+func escape(s string, quoted bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quoted {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// Serves the metrics, e.g., on /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Writes the metrics to |path|, replacing it at once so that the
+// node_exporter textfile collector never reads part of them.
+func (r *Registry) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
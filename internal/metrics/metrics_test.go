@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	runs := r.NewGauge("last_run_timestamp_seconds", "When the last run ended.")
+	errors := r.NewCounter("errors_total", "Errors by endpoint.", "endpoint")
+	r.NewGauge("unset", "Never set, so left out.")
+
+	runs.Set(1700000000.5)
+	errors.Inc("login")
+	errors.Add(2, "devices")
+	errors.Inc(`say "hi"\`)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP last_run_timestamp_seconds When the last run ended.
+# TYPE last_run_timestamp_seconds gauge
+last_run_timestamp_seconds 1.7000000005e+09
+# HELP errors_total Errors by endpoint.
+# TYPE errors_total counter
+errors_total{endpoint="devices"} 2
+errors_total{endpoint="login"} 1
+errors_total{endpoint="say \"hi\"\\"} 1
+`
+	if b.String() != want {
+		t.Errorf("want\n%v, got\n%v", want, b.String())
+	}
+
+	// A reset gauge is left out until it's set again.
+	runs.Reset()
+	b.Reset()
+	r.WriteTo(&b)
+	if strings.Contains(b.String(), "last_run") {
+		t.Errorf("expected the reset gauge to be left out, got\n%v", b.String())
+	}
+}
+
+func TestServeAndWriteFile(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("upcoming_events", "The number of upcoming events.").Set(2)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || !strings.Contains(rec.Body.String(), "upcoming_events 2") {
+		t.Errorf("expected the metrics, got %v\n%v", rec.Header(), rec.Body.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "scheduler.prom")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != rec.Body.String() {
+		t.Errorf("expected the file to have the same metrics, got\n%s", data)
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("expected no temporary file left, got %v", matches)
+	}
+}
@@ -0,0 +1,294 @@
+package program
+
+import (
+	"fmt"
+	"math"
+	"thermostat-scheduler/internal/config"
+	"time"
+)
+
+// What an Override is for, which decides how much it matters when it can't
+// be represented in the device's program.
+type OverrideKind int
+
+const (
+	Normal OverrideKind = iota // The normal program, not an override.
+	PreHeat
+	PreCool
+	Peak
+	Recovery
+)
+
+func (k OverrideKind) String() string {
+	switch k {
+	case Normal:
+		return "normal"
+	case PreHeat:
+		return "pre-heat"
+	case PreCool:
+		return "pre-cool"
+	case Peak:
+		return "peak"
+	case Recovery:
+		return "recovery"
+	}
+	return fmt.Sprintf("OverrideKind(%d)", int(k))
+}
+
+// How much a degree-hour of deviation costs for each kind. Missing a peak
+// setback is worse than missing pre-heating, pre-cooling or recovery, which
+// are all worse than a deviation from the normal program.
+func (k OverrideKind) weight() float64 {
+	switch k {
+	case PreHeat, PreCool, Recovery:
+		return 4
+	case Peak:
+		return 8
+	}
+	return 1
+}
+
+// An Override replaces the normal program's setpoint between Start and End,
+// both measured from midnight of the day it applies to.
+type Override struct {
+	Kind  OverrideKind
+	Start time.Duration
+	End   time.Duration
+	Heat  float64
+	Cool  float64
+}
+
+// A part of the intended schedule that couldn't be represented in the
+// device's program.
+type Dropped struct {
+	Weekday time.Weekday
+	Start   time.Duration
+	End     time.Duration
+	Kind    OverrideKind
+	Want    config.DayEvent // The setpoint that was intended.
+	Got     config.DayEvent // The setpoint that runs instead.
+}
+
+func (d Dropped) String() string {
+	return fmt.Sprintf("%v %v-%v (%v): wanted heat %v cool %v, got heat %v cool %v",
+		d.Weekday, formatHour(d.Start), formatHour(d.End), d.Kind,
+		d.Want.Heat, d.Want.Cool, d.Got.Heat, d.Got.Cool)
+}
+
+func formatHour(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// A stretch of the intended schedule with a single setpoint.
+type segment struct {
+	start, end time.Duration
+	kind       OverrideKind
+	heat, cool float64
+}
+
+// Allocate fits the normal program plus overrides into the device's
+// |periods| periods.
+//
+// |carryIn| is the setpoint in effect at midnight, set by the previous day's
+// night period, and |overnight| is how long the day's last setpoint keeps
+// running into the next day. Overrides are applied in order, so later ones
+// win where they overlap.
+//
+// When the intended schedule has more changes than the device has periods,
+// the changes that are kept are the ones that minimize the deviation from
+// the intended schedule, weighted by the kind of each part of it. The parts
+// that end up with a different setpoint are returned as Dropped, with
+// Weekday left for the caller to fill in.
+func Allocate(normal config.DailyProgram, carryIn config.DayEvent, overnight time.Duration,
+	overrides []Override, periods int) (config.DailyProgram, []Dropped) {
+	day := 24 * time.Hour
+	segments := normalSegments(normal, carryIn, day+overnight)
+	for _, o := range overrides {
+		start, end := clamp(o.Start, 0, day), clamp(o.End, 0, day)
+		if start >= end {
+			continue
+		}
+		segments = paint(segments, segment{start: start, end: end, kind: o.Kind, heat: o.Heat, cool: o.Cool})
+	}
+
+	// The candidates are the points where the setpoint changes during the
+	// day. Changes at or after midnight belong to the next day.
+	var changes []segment
+	previous := segment{heat: carryIn.Heat, cool: carryIn.Cool}
+	for _, s := range segments {
+		if s.start < day && (s.heat != previous.heat || s.cool != previous.cool) {
+			changes = append(changes, s)
+		}
+		previous = s
+	}
+
+	kept := changes
+	if len(changes) > periods {
+		best := -1.0
+		forEachCombination(len(changes), periods, func(indices []int) {
+			candidate := make([]segment, len(indices))
+			for i, index := range indices {
+				candidate[i] = changes[index]
+			}
+			cost := deviation(segments, candidate, carryIn)
+			if best < 0 || cost < best {
+				best = cost
+				kept = candidate
+			}
+		})
+	}
+
+	return toDailyProgram(kept, carryIn), dropped(segments, kept, carryIn, day)
+}
+
+// Returns the segments of the normal program, from midnight until |until|.
+func normalSegments(normal config.DailyProgram, carryIn config.DayEvent, until time.Duration) []segment {
+	var segments []segment
+	current := segment{heat: carryIn.Heat, cool: carryIn.Cool}
+	for _, e := range []config.DayEvent{normal.Morning, normal.Day, normal.Evening, normal.Night} {
+		if e.Time > current.start {
+			current.end = e.Time
+			segments = append(segments, current)
+		}
+		current = segment{start: e.Time, heat: e.Heat, cool: e.Cool}
+	}
+	current.end = until
+	return append(segments, current)
+}
+
+// Paints |s| over |segments|, splitting the ones it partially covers.
+func paint(segments []segment, s segment) []segment {
+	var painted []segment
+	for _, existing := range segments {
+		if existing.end <= s.start || existing.start >= s.end {
+			painted = append(painted, existing)
+			continue
+		}
+		if existing.start < s.start {
+			before := existing
+			before.end = s.start
+			painted = append(painted, before)
+		}
+		if existing.start <= s.start {
+			painted = append(painted, s)
+		}
+		if existing.end > s.end {
+			after := existing
+			after.start = s.end
+			painted = append(painted, after)
+		}
+	}
+	return painted
+}
+
+// Returns the setpoint that runs at the start of |s| when only |kept| changes
+// are programmed.
+func actualSetpoint(s segment, kept []segment, carryIn config.DayEvent) (float64, float64) {
+	heat, cool := carryIn.Heat, carryIn.Cool
+	for _, k := range kept {
+		if k.start > s.start {
+			break
+		}
+		heat, cool = k.heat, k.cool
+	}
+	return heat, cool
+}
+
+// Returns the weighted degree-hours by which |kept| deviates from |segments|.
+// Every segment that deviates also costs a fixed degree-hour, so that short
+// overrides such as pre-heating aren't dropped just for being short.
+func deviation(segments []segment, kept []segment, carryIn config.DayEvent) float64 {
+	var cost float64
+	for _, s := range segments {
+		heat, cool := actualSetpoint(s, kept, carryIn)
+		degrees := math.Abs(heat-s.heat) + math.Abs(cool-s.cool)
+		if degrees == 0 {
+			continue
+		}
+		cost += (degrees*(s.end-s.start).Hours() + 1) * s.kind.weight()
+	}
+	return cost
+}
+
+// Returns the parts of |segments| before |until| that don't get their
+// intended setpoint when only |kept| changes are programmed.
+func dropped(segments []segment, kept []segment, carryIn config.DayEvent, until time.Duration) []Dropped {
+	var result []Dropped
+	for _, s := range segments {
+		if s.start >= until {
+			break
+		}
+		heat, cool := actualSetpoint(s, kept, carryIn)
+		if heat == s.heat && cool == s.cool {
+			continue
+		}
+		d := Dropped{
+			Start: s.start,
+			End:   clamp(s.end, 0, until),
+			Kind:  s.kind,
+			Want:  config.DayEvent{Time: s.start, Heat: s.heat, Cool: s.cool},
+			Got:   config.DayEvent{Time: s.start, Heat: heat, Cool: cool},
+		}
+		// Merge with the previous part if it only differs by its time.
+		if n := len(result); n > 0 {
+			last := &result[n-1]
+			if last.End == d.Start && last.Kind == d.Kind &&
+				last.Want.Heat == d.Want.Heat && last.Want.Cool == d.Want.Cool &&
+				last.Got.Heat == d.Got.Heat && last.Got.Cool == d.Got.Cool {
+				last.End = d.End
+				continue
+			}
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+// Converts the kept changes to a DailyProgram. Unused periods repeat the last
+// change, so they have no effect.
+func toDailyProgram(kept []segment, carryIn config.DayEvent) config.DailyProgram {
+	var events []config.DayEvent
+	for _, k := range kept {
+		events = append(events, config.DayEvent{Time: k.start, Heat: k.heat, Cool: k.cool})
+	}
+	if len(events) == 0 {
+		events = append(events, config.DayEvent{Time: 0, Heat: carryIn.Heat, Cool: carryIn.Cool})
+	}
+	for len(events) < config.MaxPeriods {
+		events = append(events, events[len(events)-1])
+	}
+	return config.DailyProgram{
+		Morning: events[0],
+		Day:     events[1],
+		Evening: events[2],
+		Night:   events[3],
+	}
+}
+
+// Calls |f| with every combination of |k| indices out of |n|, in
+// lexicographic order.
+func forEachCombination(n, k int, f func([]int)) {
+	indices := make([]int, k)
+	var recurse func(position, next int)
+	recurse = func(position, next int) {
+		if position == k {
+			f(indices)
+			return
+		}
+		for i := next; i <= n-(k-position); i++ {
+			indices[position] = i
+			recurse(position+1, i+1)
+		}
+	}
+	recurse(0, 0)
+}
+
+func clamp(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
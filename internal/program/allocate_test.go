@@ -0,0 +1,86 @@
+package program
+
+import (
+	"testing"
+	"thermostat-scheduler/internal/config"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	normal := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	carryIn := normal.Night
+
+	// Without overrides, the normal program fits as is.
+	dp, dropped := Allocate(normal, carryIn, 7*time.Hour, nil, 4)
+	if dp != normal {
+		t.Errorf("want\n%v, got\n%v", normal, dp)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("expected nothing dropped, got %v", dropped)
+	}
+
+	// An override that lines up with the normal program only changes the
+	// setpoints it covers.
+	dp, dropped = Allocate(normal, carryIn, 7*time.Hour, []Override{
+		{Kind: Peak, Start: 9 * time.Hour, End: 16 * time.Hour, Heat: 18, Cool: 24},
+	}, 4)
+	expected := normal
+	expected.Day.Heat = 18
+	if dp != expected {
+		t.Errorf("want\n%v, got\n%v", expected, dp)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("expected nothing dropped, got %v", dropped)
+	}
+
+	// An override that leaves fewer changes than periods repeats the last
+	// change in the unused periods.
+	flat := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 20, Cool: 25},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 25},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 20, Cool: 25},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	dp, _ = Allocate(flat, flat.Night, 7*time.Hour, []Override{
+		{Kind: Peak, Start: 16 * time.Hour, End: 20 * time.Hour, Heat: 18, Cool: 25},
+	}, 4)
+	expected = config.DailyProgram{
+		Morning: config.DayEvent{Time: 16 * time.Hour, Heat: 18, Cool: 25},
+		Day:     config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+		Evening: config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+		Night:   config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if dp != expected {
+		t.Errorf("want\n%v, got\n%v", expected, dp)
+	}
+
+	// A peak period in the middle of the day needs one more period than the
+	// device has, so the smallest deviation from the normal program goes.
+	_, dropped = Allocate(normal, carryIn, 7*time.Hour, []Override{
+		{Kind: Peak, Start: 14 * time.Hour, End: 16 * time.Hour, Heat: 18, Cool: 24},
+	}, 4)
+	if len(dropped) != 1 || dropped[0].Kind != Normal || dropped[0].Start != 7*time.Hour {
+		t.Errorf("expected the morning period to be dropped, got %v", dropped)
+	}
+
+	// A device with fewer periods keeps fewer changes, and repeats the last
+	// one in the remaining periods.
+	dp, _ = Allocate(flat, flat.Night, 7*time.Hour, []Override{
+		{Kind: PreHeat, Start: 15 * time.Hour, End: 16 * time.Hour, Heat: 22, Cool: 25},
+		{Kind: Peak, Start: 16 * time.Hour, End: 20 * time.Hour, Heat: 18, Cool: 25},
+	}, 2)
+	expected = config.DailyProgram{
+		Morning: config.DayEvent{Time: 16 * time.Hour, Heat: 18, Cool: 25},
+		Day:     config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+		Evening: config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+		Night:   config.DayEvent{Time: 20 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if dp != expected {
+		t.Errorf("want\n%v, got\n%v", expected, dp)
+	}
+}
@@ -1,87 +1,285 @@
 package program
 
 import (
-	"log"
+	"log/slog"
+	"math"
+	"sort"
 	"thermostat-scheduler/internal/config"
 	"thermostat-scheduler/internal/events"
 	"time"
 )
 
 // Assemble a weekly program given a config, current time, and list of peak events.
-func AssembleProgram(cfg config.Config, now time.Time, events []events.PeakEvent, verbose bool) config.WeeklyProgram {
+//
+// Every event that hasn't ended yet and starts within the configured lookahead
+// is turned into pre-heat, peak and recovery overrides, so the whole week is
+// planned from a single run. Overrides are computed on the calendar and split
+// at midnight, so pre-heating or peak periods that cross midnight end up in
+// the programs of both days. Each day with overrides is then allocated to the
+// device's periods along with its normal program. When the day's
+// overrides and normal program don't fit, the allocator decides what gets
+// dropped, favoring peak periods over pre-heating and recovery, and those over
+// the normal program. The dropped parts are returned alongside the program.
+// The events that are planned for are logged to |logger|.
+func AssembleProgram(cfg config.Config, now time.Time, events []events.PeakEvent, logger *slog.Logger) (config.WeeklyProgram, []Dropped) {
+	normal := calendar{cfg.NormalProgram}
 	wp := cfg.NormalProgram
-	for _, e := range events {
-		startHour := hoursFromMidnight(e.Start)
-		endHour := hoursFromMidnight(e.End)
-
-		// Only consider events that end in the next 12 hours.
-		if now.Before(e.End) && now.Add(12*time.Hour).After(e.End) {
-			if verbose {
-				log.Println("Found relevant event: ", e)
-			}
+	today := midnight(now)
+	strategy := NewPeakStrategy(cfg.PeakProgram)
+	// A config that wasn't read with config.ReadConfig may not have a
+	// lookahead.
+	lookahead := config.MaxLookahead
+	if cfg.Lookahead != nil {
+		lookahead = *cfg.Lookahead
+	}
 
-			today := wp.DailyProgramOn(e.Start.Weekday())
-			yesterday := wp.DailyProgramBefore(e.Start.Weekday())
+	// Collect the overrides of each day, keyed by the number of days after
+	// today.
+	overrides := make(map[int][]Override)
+	for _, e := range relevantEvents(events, now, lookahead) {
+		logger.Debug("Found relevant event", "event", e)
+		start, end := e.Start.In(now.Location()), e.End.In(now.Location())
+		cooling := cfg.PeakProgram.IsCoolingEvent(e.Offer, start)
+		for _, w := range normal.peakWindows(cfg.PeakProgram, strategy, start, end, cooling, cfg.Device.TimeStep) {
+			w.split(today, overrides)
+		}
+	}
 
-			// Find the program that runs before pre-heating is meant to start.
-			beforePreHeating := wp.DayEventBefore(e.Start.Weekday(),
-				startHour-cfg.PeakProgram.PreHeatDuration)
+	// Yesterday shares its program with the last day of the week, so only
+	// its night period, which keeps running until today's first period, is
+	// adjusted to what's needed at midnight.
+	for _, o := range overrides[-1] {
+		if o.End == 24*time.Hour {
+			yesterday := wp.DailyProgramBefore(today.Weekday())
+			yesterday.Night.Heat = o.Heat
+			yesterday.Night.Cool = o.Cool
+		}
+	}
 
-			// If configured to maintain normal temp before pre-heating,
-			// copy the program that runs during the peak period instead of
-			// the one that runs before pre-heating.
-			if cfg.PeakProgram.MaintainNormalTempBeforePreHeat {
-				beforePreHeating = wp.DayEventAfter(e.Start.Weekday(), startHour)
-			}
+	// Allocate the days in order, since each day starts with the setpoint of
+	// the previous day's night period. Overrides that spill into the day
+	// that shares its program with yesterday are left for a later run.
+	var days []int
+	for day := range overrides {
+		if day >= 0 && day < 6 {
+			days = append(days, day)
+		}
+	}
+	sort.Ints(days)
 
-			// Find the program that runs before the end of the peak period.
-			// This will be used to compute the peak temperature offsets.
-			beforeEnd := wp.DayEventBefore(e.End.Weekday(),
-				endHour+cfg.PeakProgram.PeakBufferDuration)
-
-			// Pre-heating starts before the peak event, with the
-			// temperature offset.
-			preHeating := config.DayEvent{
-				Time: startHour - cfg.PeakProgram.PreHeatDuration,
-				Heat: beforeEnd.Heat + cfg.PeakProgram.PreHeatTempOffset,
-				Cool: beforeEnd.Cool,
-			}
+	// A config that wasn't read with config.ReadConfig may not have the
+	// device's capabilities.
+	periods := cfg.Device.Periods
+	if periods == 0 {
+		periods = config.MaxPeriods
+	}
 
-			// The peak period uses the temperature offset.
-			peakPeriod := config.DayEvent{
-				Time: startHour - cfg.PeakProgram.PeakBufferDuration,
-				Heat: beforeEnd.Heat + cfg.PeakProgram.PeakTempOffset,
-				Cool: beforeEnd.Cool,
-			}
+	var dropped []Dropped
+	for _, day := range days {
+		weekday := today.AddDate(0, 0, day).Weekday()
+		yesterday := wp.DailyProgramBefore(weekday)
 
-			// Back to normal once the peak period is over.
-			backToNormal := config.DayEvent{
-				Time: endHour + cfg.PeakProgram.PeakBufferDuration,
-				Heat: beforeEnd.Heat,
-				Cool: beforeEnd.Cool,
+		// The night period runs until the next day's first change, which
+		// may be one of its overrides.
+		overnight := cfg.NormalProgram.DailyProgramAfter(weekday).Morning.Time
+		for _, o := range overrides[day+1] {
+			if o.Start < overnight {
+				overnight = o.Start
 			}
+		}
+
+		dp, d := Allocate(*cfg.NormalProgram.DailyProgramOn(weekday), yesterday.Night,
+			overnight, overrides[day], periods)
+		*wp.DailyProgramOn(weekday) = dp
+		for i := range d {
+			d[i].Weekday = weekday
+		}
+		dropped = append(dropped, d...)
+	}
+	return wp, dropped
+}
+
+// Returns the events that haven't ended yet and start within |lookahead| of
+// |now|, sorted by start time, leaving out the skipped ones. Events that start
+// on the day that shares its program with yesterday are left for a later run,
+// once yesterday's night period is over.
+func relevantEvents(peakEvents []events.PeakEvent, now time.Time, lookahead time.Duration) []events.PeakEvent {
+	horizon := now.Add(lookahead)
+	if endOfWeek := midnight(now).AddDate(0, 0, 6); horizon.After(endOfWeek) {
+		horizon = endOfWeek
+	}
 
-			// Find the program that runs after the end of the peak period.
-			afterPeakPeriod := wp.DayEventAfter(e.End.Weekday(),
-				endHour+cfg.PeakProgram.PeakBufferDuration)
+	var relevant []events.PeakEvent
+	for _, e := range peakEvents {
+		if now.Before(e.End) && e.Start.Before(horizon) && !e.Skipped {
+			relevant = append(relevant, e)
+		}
+	}
+	sort.SliceStable(relevant, func(i, j int) bool {
+		return relevant[i].Start.Before(relevant[j].Start)
+	})
+	return relevant
+}
 
-			// Update the weekly program with the daily programs that were
-			// computed.
-			yesterday.Night.Heat = beforePreHeating.Heat
-			yesterday.Night.Cool = beforePreHeating.Cool
-			today.Morning.Copy(preHeating)
-			today.Day.Copy(peakPeriod)
-			today.Evening.Copy(backToNormal)
-			today.Night.Copy(afterPeakPeriod)
+// A Window replaces the normal program between Start and End. Unlike an
+// Override, it isn't tied to a particular day.
+type Window struct {
+	Kind  OverrideKind
+	Start time.Time
+	End   time.Time
+	Heat  float64
+	Cool  float64
+}
 
-			// Break early -- we only handle the one peak event.
+// Splits the window at midnight and adds the resulting overrides to
+// |overrides|, keyed by the number of days after |today|.
+func (w Window) split(today time.Time, overrides map[int][]Override) {
+	for dayStart := midnight(w.Start); dayStart.Before(w.End); dayStart = dayStart.AddDate(0, 0, 1) {
+		dayEnd := dayStart.AddDate(0, 0, 1)
+		start, end := w.Start, w.End
+		if start.Before(dayStart) {
+			start = dayStart
+		}
+		if end.After(dayEnd) {
+			end = dayEnd
+		}
+		if !start.Before(end) {
+			continue
+		}
+		day := int(math.Round(dayStart.Sub(today).Hours() / 24))
+		overrides[day] = append(overrides[day], Override{
+			Kind:  w.Kind,
+			Start: start.Sub(dayStart),
+			End:   end.Sub(dayStart),
+			Heat:  w.Heat,
+			Cool:  w.Cool,
+		})
+	}
+}
+
+// The normal program, laid out on the calendar.
+type calendar struct {
+	normal config.WeeklyProgram
+}
+
+// A change of the normal program at a specific time.
+type change struct {
+	at    time.Time
+	event config.DayEvent
+}
+
+// Returns the changes of the normal program from the day before |t| to the
+// day after, in order.
+func (c calendar) changesAround(t time.Time) []change {
+	var changes []change
+	for day := -1; day <= 1; day++ {
+		dayStart := midnight(t).AddDate(0, 0, day)
+		dp := c.normal.DailyProgramOn(dayStart.Weekday())
+		for _, e := range []config.DayEvent{dp.Morning, dp.Day, dp.Evening, dp.Night} {
+			changes = append(changes, change{at: dayStart.Add(e.Time), event: e})
+		}
+	}
+	return changes
+}
+
+// Returns the last change of the normal program at or before |t|.
+func (c calendar) changeAtOrBefore(t time.Time) change {
+	changes := c.changesAround(t)
+	last := changes[0]
+	for _, ch := range changes {
+		if ch.at.After(t) {
 			break
 		}
+		last = ch
 	}
-	return wp
+	return last
 }
 
-func hoursFromMidnight(t time.Time) time.Duration {
-	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
-	return t.Sub(midnight)
+// Returns the first change of the normal program at or after |t|.
+func (c calendar) changeAtOrAfter(t time.Time) change {
+	changes := c.changesAround(t)
+	for _, ch := range changes {
+		if !ch.at.Before(t) {
+			return ch
+		}
+	}
+	return changes[len(changes)-1]
+}
+
+// Returns the first change of the normal program strictly after |t|.
+func (c calendar) changeAfter(t time.Time) change {
+	return c.changeAtOrAfter(t.Add(time.Nanosecond))
+}
+
+// Returns the windows that modify the normal program for a peak event that
+// runs from |start| to |end|, as decided by |strategy|. The buffered peak
+// period is widened to multiples of |step|, since the thermostat rounds times
+// down to it.
+func (c calendar) peakWindows(pp config.PeakProgram, strategy PeakStrategy, start, end time.Time, cooling bool,
+	step time.Duration) []Window {
+	p := PeakPeriod{
+		EventStart: start,
+		EventEnd:   end,
+		Start:      floorTime(start.Add(-pp.PeakBufferDuration), step),
+		End:        ceilTime(end.Add(pp.PeakBufferDuration), step),
+		Cooling:    cooling,
+	}
+
+	// Find the program that runs before the end of the peak period.
+	// This will be used to compute the peak temperature offsets.
+	p.Base = c.changeAtOrBefore(p.End).event
+
+	strategyWindows := strategy.Windows(p)
+	if len(strategyWindows) == 0 {
+		return nil
+	}
+
+	var windows []Window
+
+	// If configured to maintain normal temp before pre-heating, hold the
+	// program that runs during the peak period from the start of the normal
+	// period that pre-heating interrupts.
+	if pp.MaintainNormalTempBeforePreHeat {
+		preStart := strategyWindows[0].Start
+		duringPeak := c.changeAtOrAfter(start).event
+		windows = append(windows, Window{
+			Kind:  strategyWindows[0].Kind,
+			Start: c.changeAtOrBefore(preStart).at,
+			End:   preStart,
+			Heat:  duringPeak.Heat,
+			Cool:  duringPeak.Cool,
+		})
+	}
+
+	return append(append(windows, strategyWindows...),
+		// Back to normal once the peak period is over, until the normal
+		// program changes.
+		Window{
+			Kind:  Recovery,
+			Start: p.End,
+			End:   c.changeAfter(p.End).at,
+			Heat:  p.Base.Heat,
+			Cool:  p.Base.Cool,
+		})
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Returns |t| rounded down to a multiple of |step| from midnight.
+func floorTime(t time.Time, step time.Duration) time.Time {
+	if step <= 0 {
+		return t
+	}
+	m := midnight(t)
+	return m.Add(t.Sub(m).Truncate(step))
+}
+
+// Returns |t| rounded up to a multiple of |step| from midnight.
+func ceilTime(t time.Time, step time.Duration) time.Time {
+	if f := floorTime(t, step); f.Before(t) {
+		return f.Add(step)
+	}
+	return t
 }
@@ -1,6 +1,8 @@
 package program
 
 import (
+	"log/slog"
+	"reflect"
 	"testing"
 	"thermostat-scheduler/internal/config"
 	"thermostat-scheduler/internal/events"
@@ -26,6 +28,8 @@ func TestAssembleProgram(t *testing.T) {
 			PreHeatTempOffset:  2,
 			PeakTempOffset:     -2,
 		},
+		// Only plan for the next 12 hours, to see each event in turn.
+		Lookahead: durationPtr(12 * time.Hour),
 	}
 
 	// Peak events are on Jan 24, 6h to 9h, and 16h to 20h.
@@ -42,18 +46,31 @@ func TestAssembleProgram(t *testing.T) {
 
 	// It's 4h on the morning on the peak events.
 	now := parseTime(t, "Wed, 24 Jan 2024 04:00:00 EST")
-	program := AssembleProgram(cfg, now, events, false)
+	program, dropped := AssembleProgram(cfg, now, events, slog.Default())
 
-	// Expect the current day's program to handle the morning peak period.
+	// Expect the current day's program to handle the morning peak period,
+	// and keep the normal night period.
 	expectedPeakProgram := config.DailyProgram{
 		Morning: config.DayEvent{Time: 5 * time.Hour, Heat: 20 + 2, Cool: 24},
 		Day:     config.DayEvent{Time: 6*time.Hour - 2*time.Minute, Heat: 20 - 2, Cool: 24},
 		Evening: config.DayEvent{Time: 9*time.Hour + 2*time.Minute, Heat: 20, Cool: 24},
-		Night:   config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
 	}
 	if program.Wednesday != expectedPeakProgram {
 		t.Errorf("want\n%v, got\n%v", expectedPeakProgram, program.Wednesday)
 	}
+	// Expect the normal evening period to be reported as dropped.
+	expectedDropped := []Dropped{{
+		Weekday: time.Wednesday,
+		Start:   16 * time.Hour,
+		End:     21 * time.Hour,
+		Kind:    Normal,
+		Want:    config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Got:     config.DayEvent{Time: 16 * time.Hour, Heat: 20, Cool: 24},
+	}}
+	if !reflect.DeepEqual(dropped, expectedDropped) {
+		t.Errorf("want\n%v, got\n%v", expectedDropped, dropped)
+	}
 	// Expect the previous day's night event to set now's normal temperature.
 	expectedDayEvent := config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25}
 	if program.Tuesday.Night != expectedDayEvent {
@@ -63,7 +80,7 @@ func TestAssembleProgram(t *testing.T) {
 	// Configure the program to instead maintain the usual "peak" temperature
 	// before pre-heating.
 	cfg.PeakProgram.MaintainNormalTempBeforePreHeat = true
-	program = AssembleProgram(cfg, now, events, false)
+	program, _ = AssembleProgram(cfg, now, events, slog.Default())
 
 	// Expect the same program to handle the peak period.
 	if program.Wednesday != expectedPeakProgram {
@@ -77,12 +94,19 @@ func TestAssembleProgram(t *testing.T) {
 	// Revert back the config.
 	cfg.PeakProgram.MaintainNormalTempBeforePreHeat = false
 
-	// Four hours later, at 8h, we should still have the same program since the
-	// peak period isn't over.
+	// Four hours later, at 8h, the morning peak period isn't over and the
+	// evening one is now within the lookahead.
 	now = now.Add(4 * time.Hour)
-	program = AssembleProgram(cfg, now, events, false)
+	program, _ = AssembleProgram(cfg, now, events, slog.Default())
 
-	// Expect the current day's program to handle the morning peak period.
+	// Expect the current day's program to handle both peak periods, at the
+	// expense of pre-heating.
+	expectedPeakProgram = config.DailyProgram{
+		Morning: config.DayEvent{Time: 6*time.Hour - 2*time.Minute, Heat: 20 - 2, Cool: 24},
+		Day:     config.DayEvent{Time: 9*time.Hour + 2*time.Minute, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16*time.Hour - 2*time.Minute, Heat: 21 - 2, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
 	if program.Wednesday != expectedPeakProgram {
 		t.Errorf("want\n%v, got\n%v", expectedPeakProgram, program.Wednesday)
 	}
@@ -93,7 +117,7 @@ func TestAssembleProgram(t *testing.T) {
 
 	// Two hours later at 10h, the evening peak period should now apply.
 	now = now.Add(2 * time.Hour)
-	program = AssembleProgram(cfg, now, events, false)
+	program, _ = AssembleProgram(cfg, now, events, slog.Default())
 
 	// Expect the current day's program to handle the afteroon peak period.
 	expectedPeakProgram = config.DailyProgram{
@@ -105,20 +129,345 @@ func TestAssembleProgram(t *testing.T) {
 	if program.Wednesday != expectedPeakProgram {
 		t.Errorf("at time %v, want\n%v, got\n%v", now, expectedPeakProgram, program.Wednesday)
 	}
-	// Expect the previous day's night event to set the usual temperature.
-	expectedDayEvent = config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 24}
+	// Expect the previous day's night event to be left alone.
 	if program.Tuesday.Night != expectedDayEvent {
 		t.Errorf("want\n%v, got\n%v", expectedDayEvent, program.Tuesday.Night)
 	}
 
 	// Twelve hours later, at 22h, we should be back on the normal program.
 	now = now.Add(12 * time.Hour)
-	program = AssembleProgram(cfg, now, events, false)
+	program, _ = AssembleProgram(cfg, now, events, slog.Default())
 	if program != cfg.NormalProgram {
 		t.Errorf("at time %v, want\n%v, got\n%v", now, expectedPeakProgram, program.Wednesday)
 	}
 }
 
+func TestAssembleProgramTimeStep(t *testing.T) {
+	dp := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+
+	cfg := config.Config{
+		NormalProgram: config.WeeklyProgram{
+			Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+			Thursday: dp, Friday: dp, Saturday: dp,
+		},
+		PeakProgram: config.PeakProgram{
+			PreHeatDuration:    1 * time.Hour,
+			PeakBufferDuration: 2 * time.Minute,
+			PreHeatTempOffset:  2,
+			PeakTempOffset:     -2,
+		},
+		Device: config.Capabilities{TimeStep: 10 * time.Minute, Periods: 4},
+	}
+	peakEvents := []events.PeakEvent{
+		{
+			Start: parseTime(t, "Wed, 24 Jan 2024 06:00:00 EST"),
+			End:   parseTime(t, "Wed, 24 Jan 2024 09:00:00 EST"),
+		},
+	}
+	now := parseTime(t, "Wed, 24 Jan 2024 04:00:00 EST")
+	program, _ := AssembleProgram(cfg, now, peakEvents, slog.Default())
+
+	// The buffer is widened to whole time steps, rather than being rounded
+	// away by the thermostat.
+	expected := config.DailyProgram{
+		Morning: config.DayEvent{Time: 5 * time.Hour, Heat: 20 + 2, Cool: 24},
+		Day:     config.DayEvent{Time: 5*time.Hour + 50*time.Minute, Heat: 20 - 2, Cool: 24},
+		Evening: config.DayEvent{Time: 9*time.Hour + 10*time.Minute, Heat: 20, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if program.Wednesday != expected {
+		t.Errorf("want\n%v, got\n%v", expected, program.Wednesday)
+	}
+}
+
+func TestAssembleProgramMultipleEvents(t *testing.T) {
+	dp := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+
+	cfg := config.Config{
+		NormalProgram: config.WeeklyProgram{
+			Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+			Thursday: dp, Friday: dp, Saturday: dp,
+		},
+		PeakProgram: config.PeakProgram{
+			PreHeatDuration:   1 * time.Hour,
+			PreHeatTempOffset: 2,
+			PeakTempOffset:    -2,
+		},
+	}
+
+	// At 8h30, both the AM and PM events end in the next 12 hours. They
+	// compete for the same day, so the peak periods win over pre-heating.
+	amEvent := events.PeakEvent{
+		Start: parseTime(t, "Wed, 24 Jan 2024 06:00:00 EST"),
+		End:   parseTime(t, "Wed, 24 Jan 2024 09:00:00 EST"),
+	}
+	pmEvent := events.PeakEvent{
+		Start: parseTime(t, "Wed, 24 Jan 2024 16:00:00 EST"),
+		End:   parseTime(t, "Wed, 24 Jan 2024 20:00:00 EST"),
+	}
+	now := parseTime(t, "Wed, 24 Jan 2024 08:30:00 EST")
+	program, dropped := AssembleProgram(cfg, now, []events.PeakEvent{pmEvent, amEvent}, slog.Default())
+
+	expectedAMAndPMProgram := config.DailyProgram{
+		Morning: config.DayEvent{Time: 6 * time.Hour, Heat: 20 - 2, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21 - 2, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if program.Wednesday != expectedAMAndPMProgram {
+		t.Errorf("want\n%v, got\n%v", expectedAMAndPMProgram, program.Wednesday)
+	}
+	// Expect both pre-heating periods and the PM recovery to be dropped.
+	var droppedKinds []OverrideKind
+	for _, d := range dropped {
+		droppedKinds = append(droppedKinds, d.Kind)
+	}
+	expectedKinds := []OverrideKind{PreHeat, PreHeat, Recovery}
+	if !reflect.DeepEqual(droppedKinds, expectedKinds) {
+		t.Errorf("want\n%v, got\n%v", expectedKinds, dropped)
+	}
+
+	// The day before, both events are already planned for on the same day,
+	// rather than the AM event alone.
+	now = parseTime(t, "Tue, 23 Jan 2024 19:00:00 EST")
+	program, _ = AssembleProgram(cfg, now, []events.PeakEvent{pmEvent, amEvent}, slog.Default())
+	if program.Wednesday != expectedAMAndPMProgram {
+		t.Errorf("want\n%v, got\n%v", expectedAMAndPMProgram, program.Wednesday)
+	}
+
+	// At 19h30, the PM event and the next morning's event both end in the
+	// next 12 hours, and each gets its own day.
+	nextAMEvent := events.PeakEvent{
+		Start: parseTime(t, "Thu, 25 Jan 2024 06:00:00 EST"),
+		End:   parseTime(t, "Thu, 25 Jan 2024 07:00:00 EST"),
+	}
+	now = parseTime(t, "Wed, 24 Jan 2024 19:30:00 EST")
+	program, _ = AssembleProgram(cfg, now, []events.PeakEvent{amEvent, pmEvent, nextAMEvent}, slog.Default())
+
+	expectedPMProgram := config.DailyProgram{
+		Morning: config.DayEvent{Time: 15 * time.Hour, Heat: 21 + 2, Cool: 24},
+		Day:     config.DayEvent{Time: 16 * time.Hour, Heat: 21 - 2, Cool: 24},
+		Evening: config.DayEvent{Time: 20 * time.Hour, Heat: 21, Cool: 24},
+		// The night slot keeps its time, but uses the temperature that
+		// runs before the next day's pre-heating.
+		Night: config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if program.Wednesday != expectedPMProgram {
+		t.Errorf("want\n%v, got\n%v", expectedPMProgram, program.Wednesday)
+	}
+	expectedNextAMProgram := config.DailyProgram{
+		Morning: config.DayEvent{Time: 5 * time.Hour, Heat: 21 + 2, Cool: 24},
+		Day:     config.DayEvent{Time: 6 * time.Hour, Heat: 21 - 2, Cool: 24},
+		Evening: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	if program.Thursday != expectedNextAMProgram {
+		t.Errorf("want\n%v, got\n%v", expectedNextAMProgram, program.Thursday)
+	}
+
+	// A skipped event is left out of the program.
+	nextAMEvent.Skipped = true
+	program, _ = AssembleProgram(cfg, now, []events.PeakEvent{amEvent, pmEvent, nextAMEvent}, slog.Default())
+	if program.Thursday != dp {
+		t.Errorf("want the normal program\n%v, got\n%v", dp, program.Thursday)
+	}
+}
+
+func TestAssembleProgramFullWeek(t *testing.T) {
+	dp := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+
+	cfg := config.Config{
+		NormalProgram: config.WeeklyProgram{
+			Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+			Thursday: dp, Friday: dp, Saturday: dp,
+		},
+		PeakProgram: config.PeakProgram{
+			PreHeatDuration:   1 * time.Hour,
+			PreHeatTempOffset: 2,
+			PeakTempOffset:    -2,
+		},
+	}
+
+	peakEvents := []events.PeakEvent{
+		// Already over.
+		{
+			Start: parseTime(t, "Tue, 23 Jan 2024 16:00:00 EST"),
+			End:   parseTime(t, "Tue, 23 Jan 2024 20:00:00 EST"),
+		},
+		{
+			Start: parseTime(t, "Thu, 25 Jan 2024 16:00:00 EST"),
+			End:   parseTime(t, "Thu, 25 Jan 2024 20:00:00 EST"),
+		},
+		{
+			Start: parseTime(t, "Sun, 28 Jan 2024 16:00:00 EST"),
+			End:   parseTime(t, "Sun, 28 Jan 2024 20:00:00 EST"),
+		},
+		// On the day that shares its program with yesterday.
+		{
+			Start: parseTime(t, "Tue, 30 Jan 2024 16:00:00 EST"),
+			End:   parseTime(t, "Tue, 30 Jan 2024 20:00:00 EST"),
+		},
+	}
+
+	// A single run on Wednesday morning plans the rest of the week.
+	now := parseTime(t, "Wed, 24 Jan 2024 05:00:00 EST")
+	program, _ := AssembleProgram(cfg, now, peakEvents, slog.Default())
+
+	expectedPeakProgram := config.DailyProgram{
+		Morning: config.DayEvent{Time: 15 * time.Hour, Heat: 21 + 2, Cool: 24},
+		Day:     config.DayEvent{Time: 16 * time.Hour, Heat: 21 - 2, Cool: 24},
+		Evening: config.DayEvent{Time: 20 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+	expected := cfg.NormalProgram
+	expected.Thursday = expectedPeakProgram
+	expected.Sunday = expectedPeakProgram
+	if program != expected {
+		t.Errorf("want\n%v, got\n%v", expected, program)
+	}
+
+	// With a shorter lookahead, only Thursday's event is planned.
+	cfg.Lookahead = durationPtr(48 * time.Hour)
+	program, _ = AssembleProgram(cfg, now, peakEvents, slog.Default())
+	expected.Sunday = dp
+	if program != expected {
+		t.Errorf("want\n%v, got\n%v", expected, program)
+	}
+}
+
+func TestAssembleProgramAcrossMidnight(t *testing.T) {
+	dp := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 21, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 20, Cool: 24},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 20, Cool: 25},
+	}
+
+	cfg := config.Config{
+		NormalProgram: config.WeeklyProgram{
+			Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+			Thursday: dp, Friday: dp, Saturday: dp,
+		},
+		PeakProgram: config.PeakProgram{
+			PreHeatDuration:   1 * time.Hour,
+			PreHeatTempOffset: 2,
+			PeakTempOffset:    -2,
+		},
+	}
+	now := parseTime(t, "Wed, 24 Jan 2024 12:00:00 EST")
+
+	// A midnight event pre-heats the evening before.
+	midnightEvent := events.PeakEvent{
+		Start: parseTime(t, "Thu, 25 Jan 2024 00:00:00 EST"),
+		End:   parseTime(t, "Thu, 25 Jan 2024 02:00:00 EST"),
+	}
+	program, _ := AssembleProgram(cfg, now, []events.PeakEvent{midnightEvent}, slog.Default())
+
+	expectedPreHeating := config.DayEvent{Time: 23 * time.Hour, Heat: 20 + 2, Cool: 25}
+	if program.Wednesday.Night != expectedPreHeating {
+		t.Errorf("want\n%v, got\n%v", expectedPreHeating, program.Wednesday.Night)
+	}
+	expectedPeak := config.DayEvent{Time: 0, Heat: 20 - 2, Cool: 25}
+	if program.Thursday.Morning != expectedPeak {
+		t.Errorf("want\n%v, got\n%v", expectedPeak, program.Thursday.Morning)
+	}
+	expectedRecovery := config.DayEvent{Time: 2 * time.Hour, Heat: 20, Cool: 25}
+	if program.Thursday.Day != expectedRecovery {
+		t.Errorf("want\n%v, got\n%v", expectedRecovery, program.Thursday.Day)
+	}
+
+	// A late event keeps the peak temperature past midnight.
+	lateEvent := events.PeakEvent{
+		Start: parseTime(t, "Wed, 24 Jan 2024 22:00:00 EST"),
+		End:   parseTime(t, "Thu, 25 Jan 2024 01:00:00 EST"),
+	}
+	program, _ = AssembleProgram(cfg, now, []events.PeakEvent{lateEvent}, slog.Default())
+
+	expectedPreHeating = config.DayEvent{Time: 21 * time.Hour, Heat: 20 + 2, Cool: 25}
+	if program.Wednesday.Evening != expectedPreHeating {
+		t.Errorf("want\n%v, got\n%v", expectedPreHeating, program.Wednesday.Evening)
+	}
+	expectedPeak = config.DayEvent{Time: 22 * time.Hour, Heat: 20 - 2, Cool: 25}
+	if program.Wednesday.Night != expectedPeak {
+		t.Errorf("want\n%v, got\n%v", expectedPeak, program.Wednesday.Night)
+	}
+	expectedRecovery = config.DayEvent{Time: 1 * time.Hour, Heat: 20, Cool: 25}
+	if program.Thursday.Morning != expectedRecovery {
+		t.Errorf("want\n%v, got\n%v", expectedRecovery, program.Thursday.Morning)
+	}
+}
+
+func TestAssembleProgramCoolingEvent(t *testing.T) {
+	dp := config.DailyProgram{
+		Morning: config.DayEvent{Time: 7 * time.Hour, Heat: 19, Cool: 24},
+		Day:     config.DayEvent{Time: 9 * time.Hour, Heat: 18, Cool: 26},
+		Evening: config.DayEvent{Time: 16 * time.Hour, Heat: 19, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 18, Cool: 23},
+	}
+
+	cfg := config.Config{
+		NormalProgram: config.WeeklyProgram{
+			Sunday: dp, Monday: dp, Tuesday: dp, Wednesday: dp,
+			Thursday: dp, Friday: dp, Saturday: dp,
+		},
+		PeakProgram: config.PeakProgram{
+			PreHeatDuration:    1 * time.Hour,
+			PreHeatTempOffset:  2,
+			PeakTempOffset:     -2,
+			PreCoolDuration:    2 * time.Hour,
+			PreCoolTempOffset:  -2,
+			PeakCoolTempOffset: 3,
+			CoolingMonths:      []time.Month{time.July},
+			CoolingOffers:      []string{"ETE"},
+		},
+	}
+
+	expectedPeakProgram := config.DailyProgram{
+		Morning: config.DayEvent{Time: 14 * time.Hour, Heat: 19, Cool: 24 - 2},
+		Day:     config.DayEvent{Time: 16 * time.Hour, Heat: 19, Cool: 24 + 3},
+		Evening: config.DayEvent{Time: 19 * time.Hour, Heat: 19, Cool: 24},
+		Night:   config.DayEvent{Time: 21 * time.Hour, Heat: 18, Cool: 23},
+	}
+
+	// An event in July is a cooling event.
+	julyEvent := events.PeakEvent{
+		Start: parseTime(t, "Wed, 24 Jul 2024 16:00:00 EST"),
+		End:   parseTime(t, "Wed, 24 Jul 2024 19:00:00 EST"),
+	}
+	now := parseTime(t, "Wed, 24 Jul 2024 05:00:00 EST")
+	program, _ := AssembleProgram(cfg, now, []events.PeakEvent{julyEvent}, slog.Default())
+	if program.Wednesday != expectedPeakProgram {
+		t.Errorf("want\n%v, got\n%v", expectedPeakProgram, program.Wednesday)
+	}
+
+	// So is an event for a cooling offer, in any month.
+	offerEvent := events.PeakEvent{
+		Start: parseTime(t, "Wed, 24 Jan 2024 16:00:00 EST"),
+		End:   parseTime(t, "Wed, 24 Jan 2024 19:00:00 EST"),
+		Offer: "ETE",
+	}
+	now = parseTime(t, "Wed, 24 Jan 2024 05:00:00 EST")
+	program, _ = AssembleProgram(cfg, now, []events.PeakEvent{offerEvent}, slog.Default())
+	if program.Wednesday != expectedPeakProgram {
+		t.Errorf("want\n%v, got\n%v", expectedPeakProgram, program.Wednesday)
+	}
+}
+
 func parseTime(t *testing.T, timeStr string) time.Time {
 	parsedTime, err := time.Parse(time.RFC1123, timeStr)
 	if err != nil {
@@ -126,3 +475,7 @@ func parseTime(t *testing.T, timeStr string) time.Time {
 	}
 	return parsedTime
 }
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
@@ -0,0 +1,182 @@
+package program
+
+import (
+	"thermostat-scheduler/internal/config"
+	"time"
+)
+
+// A PeakPeriod is a peak event, as seen by a PeakStrategy.
+type PeakPeriod struct {
+	// When the peak event starts and ends.
+	EventStart time.Time
+	EventEnd   time.Time
+
+	// When the peak temperature starts and ends, including the peak buffer.
+	Start time.Time
+	End   time.Time
+
+	// The normal program setpoint at the end of the peak period, which
+	// offsets are relative to.
+	Base config.DayEvent
+
+	// Whether this is a cooling event rather than a heating one.
+	Cooling bool
+}
+
+// A PeakStrategy decides the temperatures before and during a peak event.
+type PeakStrategy interface {
+	// Returns the windows that replace the normal program before and
+	// during |p|, in order. Recovery once the peak period is over is handled
+	// by the caller.
+	Windows(p PeakPeriod) []Window
+}
+
+// Returns the PeakStrategy selected in |pp|, which must have been validated.
+func NewPeakStrategy(pp config.PeakProgram) PeakStrategy {
+	switch pp.StrategyName() {
+	case config.AbsoluteStrategyName:
+		return absoluteStrategy{pp}
+	case config.CoastStrategyName:
+		return coastStrategy{pp}
+	case config.StagedStrategyName:
+		return stagedStrategy{pp}
+	}
+	return offsetStrategy{pp}
+}
+
+// Returns the window before the peak period, from |duration| before the
+// event until the peak period starts.
+func preWindow(p PeakPeriod, duration time.Duration, heat, cool float64) Window {
+	kind := PreHeat
+	if p.Cooling {
+		kind = PreCool
+	}
+	return Window{Kind: kind, Start: p.EventStart.Add(-duration), End: p.Start, Heat: heat, Cool: cool}
+}
+
+// Returns the window for the whole peak period.
+func peakWindow(p PeakPeriod, heat, cool float64) Window {
+	return Window{Kind: Peak, Start: p.Start, End: p.End, Heat: heat, Cool: cool}
+}
+
+// Pre-heats and sets back by offsets relative to the normal program.
+type offsetStrategy struct {
+	pp config.PeakProgram
+}
+
+func (s offsetStrategy) Windows(p PeakPeriod) []Window {
+	if p.Cooling {
+		return []Window{
+			preWindow(p, s.pp.PreCoolDuration, p.Base.Heat, s.clampCool(p.Base.Cool+s.pp.PreCoolTempOffset)),
+			peakWindow(p, p.Base.Heat, s.clampCool(p.Base.Cool+s.pp.PeakCoolTempOffset)),
+		}
+	}
+	return []Window{
+		preWindow(p, s.pp.PreHeatDuration, s.clampHeat(p.Base.Heat+s.pp.PreHeatTempOffset), p.Base.Cool),
+		peakWindow(p, s.clampHeat(p.Base.Heat+s.pp.PeakTempOffset), p.Base.Cool),
+	}
+}
+
+func (s offsetStrategy) clampHeat(temp float64) float64 {
+	return clampTemp(temp, s.pp.MinTemp, s.pp.MaxTemp)
+}
+
+func (s offsetStrategy) clampCool(temp float64) float64 {
+	return clampTemp(temp, s.pp.MinCoolTemp, s.pp.MaxCoolTemp)
+}
+
+// Keeps |temp| between |lo| and |hi|, where zero leaves that side unbounded.
+func clampTemp(temp, lo, hi float64) float64 {
+	if lo != 0 && temp < lo {
+		return lo
+	}
+	if hi != 0 && temp > hi {
+		return hi
+	}
+	return temp
+}
+
+// Uses fixed setpoints, falling back to the normal program's for the ones
+// that aren't set.
+type absoluteStrategy struct {
+	pp config.PeakProgram
+}
+
+func (s absoluteStrategy) Windows(p PeakPeriod) []Window {
+	if p.Cooling {
+		return []Window{
+			preWindow(p, s.pp.PreCoolDuration, p.Base.Heat, orDefault(s.pp.Absolute.PreCoolTemp, p.Base.Cool)),
+			peakWindow(p, p.Base.Heat, orDefault(s.pp.Absolute.PeakCoolTemp, p.Base.Cool)),
+		}
+	}
+	return []Window{
+		preWindow(p, s.pp.PreHeatDuration, orDefault(s.pp.Absolute.PreHeatTemp, p.Base.Heat), p.Base.Cool),
+		peakWindow(p, orDefault(s.pp.Absolute.PeakTemp, p.Base.Heat), p.Base.Cool),
+	}
+}
+
+func orDefault(temp, fallback float64) float64 {
+	if temp == 0 {
+		return fallback
+	}
+	return temp
+}
+
+// Pre-heats, then lets the temperature drift to the minimum safe setpoint.
+type coastStrategy struct {
+	pp config.PeakProgram
+}
+
+func (s coastStrategy) Windows(p PeakPeriod) []Window {
+	c := s.pp.Coast
+	if p.Cooling {
+		return []Window{
+			preWindow(p, s.pp.PreCoolDuration, p.Base.Heat, p.Base.Cool+c.PreCoolTempOffset),
+			peakWindow(p, p.Base.Heat, orDefault(c.MaxCoolTemp, p.Base.Cool)),
+		}
+	}
+	return []Window{
+		preWindow(p, s.pp.PreHeatDuration, p.Base.Heat+c.PreHeatTempOffset, p.Base.Cool),
+		peakWindow(p, c.MinTemp, p.Base.Cool),
+	}
+}
+
+// Pre-heats, then sets back further as the peak event goes on.
+type stagedStrategy struct {
+	pp config.PeakProgram
+}
+
+func (s stagedStrategy) Windows(p PeakPeriod) []Window {
+	st := s.pp.Staged
+	var windows []Window
+	if p.Cooling {
+		windows = append(windows, preWindow(p, s.pp.PreCoolDuration, p.Base.Heat, p.Base.Cool+st.PreCoolTempOffset))
+	} else {
+		windows = append(windows, preWindow(p, s.pp.PreHeatDuration, p.Base.Heat+st.PreHeatTempOffset, p.Base.Cool))
+	}
+
+	// Each step runs until the next one starts, and the last one until the
+	// end of the peak period.
+	for i, step := range st.Steps {
+		w := peakWindow(p, p.Base.Heat, p.Base.Cool)
+		if i > 0 {
+			w.Start = p.EventStart.Add(step.After)
+		}
+		if i+1 < len(st.Steps) {
+			w.End = p.EventStart.Add(st.Steps[i+1].After)
+		}
+		if !w.Start.Before(p.End) {
+			break
+		}
+		if w.End.After(p.End) {
+			w.End = p.End
+		}
+		if p.Cooling {
+			w.Cool += step.CoolTempOffset
+		} else {
+			w.Heat += step.TempOffset
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
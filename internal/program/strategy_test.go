@@ -0,0 +1,107 @@
+package program
+
+import (
+	"reflect"
+	"testing"
+	"thermostat-scheduler/internal/config"
+	"time"
+)
+
+func TestPeakStrategies(t *testing.T) {
+	start := parseTime(t, "Wed, 24 Jan 2024 16:00:00 EST")
+	end := parseTime(t, "Wed, 24 Jan 2024 20:00:00 EST")
+	p := PeakPeriod{
+		EventStart: start,
+		EventEnd:   end,
+		Start:      start,
+		End:        end,
+		Base:       config.DayEvent{Time: 16 * time.Hour, Heat: 21, Cool: 24},
+	}
+	preHeatStart := start.Add(-1 * time.Hour)
+
+	tests := []struct {
+		name string
+		pp   config.PeakProgram
+		want []Window
+	}{
+		{
+			name: "offset",
+			pp: config.PeakProgram{
+				PreHeatDuration:   1 * time.Hour,
+				PreHeatTempOffset: 2,
+				PeakTempOffset:    -2,
+			},
+			want: []Window{
+				{Kind: PreHeat, Start: preHeatStart, End: start, Heat: 23, Cool: 24},
+				{Kind: Peak, Start: start, End: end, Heat: 19, Cool: 24},
+			},
+		},
+		{
+			name: "absolute",
+			pp: config.PeakProgram{
+				PreHeatDuration: 1 * time.Hour,
+				Absolute:        config.AbsoluteStrategy{PreHeatTemp: 22, PeakTemp: 17},
+			},
+			want: []Window{
+				{Kind: PreHeat, Start: preHeatStart, End: start, Heat: 22, Cool: 24},
+				{Kind: Peak, Start: start, End: end, Heat: 17, Cool: 24},
+			},
+		},
+		{
+			name: "clamped offset",
+			pp: config.PeakProgram{
+				PreHeatDuration:   1 * time.Hour,
+				PreHeatTempOffset: 3,
+				PeakTempOffset:    -5,
+				MinTemp:           18,
+				MaxTemp:           23,
+			},
+			want: []Window{
+				{Kind: PreHeat, Start: preHeatStart, End: start, Heat: 23, Cool: 24},
+				{Kind: Peak, Start: start, End: end, Heat: 18, Cool: 24},
+			},
+		},
+		{
+			name: "coast",
+			pp: config.PeakProgram{
+				Strategy:        config.CoastStrategyName,
+				PreHeatDuration: 1 * time.Hour,
+				Coast:           config.CoastStrategy{PreHeatTempOffset: 1, MinTemp: 15},
+			},
+			want: []Window{
+				{Kind: PreHeat, Start: preHeatStart, End: start, Heat: 22, Cool: 24},
+				{Kind: Peak, Start: start, End: end, Heat: 15, Cool: 24},
+			},
+		},
+		{
+			name: "staged",
+			pp: config.PeakProgram{
+				Strategy:        config.StagedStrategyName,
+				PreHeatDuration: 1 * time.Hour,
+				Staged: config.StagedStrategy{
+					PreHeatTempOffset: 2,
+					Steps: []config.StagedStep{
+						{After: 0, TempOffset: -1},
+						{After: 2 * time.Hour, TempOffset: -3},
+						// Starts after the end of the event.
+						{After: 5 * time.Hour, TempOffset: -5},
+					},
+				},
+			},
+			want: []Window{
+				{Kind: PreHeat, Start: preHeatStart, End: start, Heat: 23, Cool: 24},
+				{Kind: Peak, Start: start, End: start.Add(2 * time.Hour), Heat: 20, Cool: 24},
+				{Kind: Peak, Start: start.Add(2 * time.Hour), End: end, Heat: 18, Cool: 24},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewPeakStrategy(tt.pp).Windows(p)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want\n%v, got\n%v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Package retry retries operations that fail transiently, with exponential
+// backoff and jitter, within an overall deadline.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How to retry an operation. The zero Policy tries once.
+type Policy struct {
+	// The most times to try, including the first one, e.g., 3
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// How long to wait before the first retry, e.g., "1s". The wait doubles
+	// after every attempt, and a random part of it is used, so that clients
+	// don't retry in lockstep.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// The longest to wait between attempts, e.g., "30s"
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// The longest to keep retrying for, including the attempts themselves,
+	// e.g., "2m". Zero doesn't limit it.
+	Deadline time.Duration `yaml:"deadline"`
+
+	// Replaced in tests.
+	sleep func(time.Duration)
+	now   func() time.Time
+}
+
+// Wraps an error that is worth retrying.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Marks |err| as transient, so that Do retries it. A positive |after| is the
+// least to wait before retrying, e.g., from a Retry-After header.
+func Retryable(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err, after: after}
+}
+
+// Returns whether |err| was marked as Retryable.
+func IsRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+// Calls |f| until it succeeds or returns an error that isn't Retryable, or
+// until the attempts or the deadline run out. Returns the last error.
+func (p Policy) Do(f func() error) error {
+	return p.DoContext(context.Background(), f)
+}
+
+// Like Do, but also stops waiting to retry when |ctx| is done, returning the
+// last error.
+func (p Policy) DoContext(ctx context.Context, f func() error) error {
+	sleep, now := p.sleep, p.now
+	if sleep == nil {
+		sleep = func(d time.Duration) {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+		}
+	}
+	if now == nil {
+		now = time.Now
+	}
+	rng := rand.New(rand.NewSource(now().UnixNano()))
+
+	start := now()
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		var r *retryableError
+		if err == nil || !errors.As(err, &r) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		wait := time.Duration(0)
+		if backoff > 0 {
+			wait = time.Duration(rng.Int63n(int64(backoff))) + 1
+		}
+		if r.after > wait {
+			wait = r.after
+		}
+		if p.Deadline > 0 && now().Add(wait).Sub(start) >= p.Deadline {
+			return err
+		}
+		sleep(wait)
+		if ctx.Err() != nil {
+			return err
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// Returns how long the Retry-After header of a response asks to wait, which
+// is either a number of seconds or a date, or zero when it isn't set.
+func After(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
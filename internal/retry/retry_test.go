@@ -0,0 +1,119 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Returns |p| with a fake clock that only moves when sleeping, and the list
+// of waits.
+func fakeClock(p Policy) (Policy, *[]time.Duration) {
+	var waits []time.Duration
+	now := time.Date(2024, 1, 24, 5, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	p.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		now = now.Add(d)
+	}
+	return p, &waits
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	transient := errors.New("transient")
+
+	// Retryable errors are retried with growing, but bounded, waits.
+	p, waits := fakeClock(policy)
+	attempts := 0
+	err := p.Do(func() error {
+		attempts++
+		return Retryable(transient, 0)
+	})
+	if !errors.Is(err, transient) || attempts != 4 {
+		t.Errorf("expected 4 attempts and the last error, got %v and %v", attempts, err)
+	}
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if w := (*waits)[i]; w <= 0 || w > max {
+			t.Errorf("expected wait %v to be at most %v, got %v", i, max, w)
+		}
+	}
+
+	// Other errors aren't retried.
+	p, _ = fakeClock(policy)
+	attempts = 0
+	permanent := errors.New("permanent")
+	err = p.Do(func() error {
+		attempts++
+		return permanent
+	})
+	if err != permanent || attempts != 1 {
+		t.Errorf("expected a single attempt, got %v and %v", attempts, err)
+	}
+
+	// A success stops retrying.
+	p, _ = fakeClock(policy)
+	attempts = 0
+	err = p.Do(func() error {
+		attempts++
+		if attempts < 2 {
+			return Retryable(transient, 0)
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("expected success on the second attempt, got %v and %v", attempts, err)
+	}
+
+	// The wait asked for is respected.
+	p, waits = fakeClock(policy)
+	attempts = 0
+	p.Do(func() error {
+		attempts++
+		if attempts < 2 {
+			return Retryable(transient, time.Minute)
+		}
+		return nil
+	})
+	if len(*waits) != 1 || (*waits)[0] != time.Minute {
+		t.Errorf("expected to wait a minute, got %v", *waits)
+	}
+
+	// Retrying stops when the next attempt would be past the deadline.
+	policy.Deadline = 30 * time.Second
+	p, _ = fakeClock(policy)
+	attempts = 0
+	p.Do(func() error {
+		attempts++
+		return Retryable(transient, 20*time.Second)
+	})
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts within the deadline, got %v", attempts)
+	}
+
+	// The zero policy tries once.
+	attempts = 0
+	Policy{}.Do(func() error {
+		attempts++
+		return Retryable(transient, 0)
+	})
+	if attempts != 1 {
+		t.Errorf("expected a single attempt, got %v", attempts)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	// A cancelled context stops waiting to retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	transient := errors.New("transient")
+	err := Policy{MaxAttempts: 3, InitialBackoff: time.Hour}.DoContext(ctx, func() error {
+		attempts++
+		cancel()
+		return Retryable(transient, 0)
+	})
+	if !errors.Is(err, transient) || attempts != 1 {
+		t.Errorf("expected a single attempt and its error, got %v and %v", attempts, err)
+	}
+}